@@ -0,0 +1,175 @@
+//////////////////////////////////////////////////////////////////////
+// auth.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "net/smtp"
+    "strconv"
+    "strings"
+)
+
+// PLAIN auth allowed over an unencrypted connection.
+type insecurePlainAuth struct {
+    userName string
+    password string
+    host string
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Start the PLAIN authentication.
+//////////////////////////////////////////////////////////////////////
+func (a *insecurePlainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+    if server.Name != a.host {
+        return "", nil, errors.New("wrong host name")
+    }
+    resp := []byte("\x00" + a.userName + "\x00" + a.password)
+    return string(AUTH_METHOD_PLAIN), resp, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Continue the PLAIN authentication.
+//////////////////////////////////////////////////////////////////////
+func (a *insecurePlainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+    if more {
+        return nil, errors.New("unexpected server challenge")
+    }
+    return nil, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Start the SCRAM-SHA-256 authentication with the client-first message.
+// Channel binding is not supported.
+//////////////////////////////////////////////////////////////////////
+func (a *ScramSha256Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+    if server.Name != a.Host {
+        return "", nil, errors.New("wrong host name")
+    }
+    b := make([]byte, 18)
+    if _, err := rand.Read(b); err != nil {
+        return "", nil, errors.New("rand.Read() error. err=" + err.Error())
+    }
+    a.nonce = base64.StdEncoding.EncodeToString(b)
+    userName := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.UserName)
+    a.clientFirstBare = "n=" + userName + ",r=" + a.nonce
+    a.authMessage = ""
+    a.serverSignature = nil
+    return string(AUTH_METHOD_SCRAM_SHA_256), []byte("n,," + a.clientFirstBare), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Continue the SCRAM-SHA-256 authentication.
+// The client-final message is returned for the server-first message, and
+// then the server signature in the server-final message is verified.
+//////////////////////////////////////////////////////////////////////
+func (a *ScramSha256Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+    if !more {
+        if a.authMessage == "" || a.serverSignature != nil {
+            return nil, errors.New("server signature is not verified")
+        }
+        return nil, nil
+    }
+    attrs := parseScramAttributes(string(fromServer))
+    if e, ok := attrs["e"]; ok {
+        return nil, errors.New("SCRAM error. err=" + e)
+    }
+    if a.authMessage == "" {
+        return a.clientFinal(string(fromServer), attrs)
+    }
+    if a.serverSignature == nil {
+        return nil, errors.New("unexpected server challenge")
+    }
+    signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+    if err != nil || !hmac.Equal(signature, a.serverSignature) {
+        return nil, errors.New("invalid server signature")
+    }
+    a.serverSignature = nil
+    return []byte{}, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate the client-final message with the proof.
+//////////////////////////////////////////////////////////////////////
+func (a *ScramSha256Auth) clientFinal(serverFirst string, attrs map[string]string) ([]byte, error) {
+    nonce := attrs["r"]
+    if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+        return nil, errors.New("invalid server nonce")
+    }
+    salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+    if err != nil || len(salt) == 0 {
+        return nil, errors.New("invalid salt. s=" + attrs["s"])
+    }
+    iterations, err := strconv.Atoi(attrs["i"])
+    if err != nil || iterations < 1 {
+        return nil, errors.New("invalid iteration count. i=" + attrs["i"])
+    }
+    // "biws" is base64 of the GS2 header "n,,".
+    clientFinalWithoutProof := "c=biws,r=" + nonce
+    a.authMessage = a.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+    saltedPassword := pbkdf2Sha256([]byte(a.Password), salt, iterations)
+    clientKey := hmacSha256(saltedPassword, []byte("Client Key"))
+    storedKey := sha256.Sum256(clientKey)
+    clientSignature := hmacSha256(storedKey[:], []byte(a.authMessage))
+    proof := make([]byte, len(clientKey))
+    for i := range clientKey {
+        proof[i] = clientKey[i] ^ clientSignature[i]
+    }
+    serverKey := hmacSha256(saltedPassword, []byte("Server Key"))
+    a.serverSignature = hmacSha256(serverKey, []byte(a.authMessage))
+    return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Parse SCRAM attributes (e.g. "r=abc,s=QSXCR+Q6sek8bf92,i=4096").
+//////////////////////////////////////////////////////////////////////
+func parseScramAttributes(s string) map[string]string {
+    attrs := make(map[string]string)
+    for _, attr := range strings.Split(s, ",") {
+        if len(attr) >= 2 && attr[1] == '=' {
+            attrs[attr[:1]] = attr[2:]
+        }
+    }
+    return attrs
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Calculate HMAC-SHA-256.
+//////////////////////////////////////////////////////////////////////
+func hmacSha256(key []byte, data []byte) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write(data)
+    return mac.Sum(nil)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Derive the salted password with PBKDF2-HMAC-SHA-256 (RFC8018).
+// The length is the same as the hash, so it is a single block.
+//////////////////////////////////////////////////////////////////////
+func pbkdf2Sha256(password []byte, salt []byte, iterations int) []byte {
+    u := hmacSha256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+    result := append([]byte{}, u...)
+    for n := 1; n < iterations; n++ {
+        u = hmacSha256(password, u)
+        for i := range result {
+            result[i] ^= u[i]
+        }
+    }
+    return result
+}
@@ -0,0 +1,109 @@
+//////////////////////////////////////////////////////////////////////
+// auth_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "net/smtp"
+    "strings"
+    "testing"
+)
+
+// The example of RFC7677 section 3.
+const (
+    testScramClientNonce = "rOprNGfwEbeRWgbNEkqO"
+    testScramServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+    testScramClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+    testScramServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Start SCRAM-SHA-256 with the client nonce of RFC7677.
+//////////////////////////////////////////////////////////////////////
+func startTestScram(t *testing.T) *ScramSha256Auth {
+    t.Helper()
+    a := GenScramSha256Auth("user", "pencil", "mail.example.com").ScramSha256Auth
+    mech, resp, err := a.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+    if err != nil {
+        t.Fatalf("(*ScramSha256Auth) Start() error. err=%v", err)
+    }
+    if mech != "SCRAM-SHA-256" || !strings.HasPrefix(string(resp), "n,,n=user,r=") {
+        t.Fatalf("unexpected client-first message. mech=%s, resp=%q", mech, resp)
+    }
+    // The nonce is random, so it is replaced with the one of RFC7677.
+    a.nonce = testScramClientNonce
+    a.clientFirstBare = "n=user,r=" + testScramClientNonce
+    return a
+}
+
+
+func TestScramSha256Auth(t *testing.T) {
+    a := startTestScram(t)
+    resp, err := a.Next([]byte(testScramServerFirst), true)
+    if err != nil {
+        t.Fatalf("(*ScramSha256Auth) Next() error for server-first. err=%v", err)
+    }
+    if string(resp) != testScramClientFinal {
+        t.Errorf("client-final=%q, want %q", resp, testScramClientFinal)
+    }
+    if _, err = a.Next([]byte(testScramServerFinal), true); err != nil {
+        t.Fatalf("(*ScramSha256Auth) Next() error for server-final. err=%v", err)
+    }
+    if _, err = a.Next(nil, false); err != nil {
+        t.Errorf("(*ScramSha256Auth) Next() error at the end. err=%v", err)
+    }
+}
+
+
+func TestScramSha256AuthErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        serverFirst string
+        serverFinal string
+    }{
+        {"server error", "e=invalid-proof", ""},
+        {"nonce not extended", "r=" + testScramClientNonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", ""},
+        {"other nonce", "r=other%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", ""},
+        {"invalid salt", "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=!,i=4096", ""},
+        {"invalid iteration count", "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0", ""},
+        {"wrong server signature", testScramServerFirst, "v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+        {"no server signature", testScramServerFirst, "-"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            a := startTestScram(t)
+            _, err := a.Next([]byte(tt.serverFirst), true)
+            if tt.serverFinal == "" {
+                if err == nil {
+                    t.Error("(*ScramSha256Auth) Next() succeeded for server-first")
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("(*ScramSha256Auth) Next() error for server-first. err=%v", err)
+            }
+            if tt.serverFinal == "-" {
+                // The server ends without the server-final message.
+                _, err = a.Next(nil, false)
+            } else {
+                _, err = a.Next([]byte(tt.serverFinal), true)
+            }
+            if err == nil {
+                t.Error("(*ScramSha256Auth) Next() succeeded for server-final")
+            }
+        })
+    }
+}
+
+
+func TestScramSha256AuthWrongHost(t *testing.T) {
+    a := GenScramSha256Auth("user", "pencil", "mail.example.com").ScramSha256Auth
+    if _, _, err := a.Start(&smtp.ServerInfo{Name: "evil.example.com", TLS: true}); err == nil {
+        t.Error("(*ScramSha256Auth) Start() succeeded for a wrong host")
+    }
+}
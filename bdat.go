@@ -0,0 +1,134 @@
+//////////////////////////////////////////////////////////////////////
+// bdat.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "fmt"
+    "net/smtp"
+    "net/textproto"
+    "strconv"
+)
+
+const (
+    // Messages larger than it are sent with BDAT if the server supports CHUNKING.
+    bdatThreshold = 1 << 20
+    bdatChunkSize = 1 << 20
+)
+
+// Writer sending the message in BDAT chunks (RFC3030).
+// The data is sent as it is without dot-stuffing.
+type bdatWriter struct {
+    buffer []byte
+    text *textproto.Conn
+}
+
+// Writer sending the message with DATA if it is up to bdatThreshold, or
+// in BDAT chunks otherwise. The size is counted while writing, so that
+// the message is composed only once without knowing its size beforehand.
+type dataOrBdatWriter struct {
+    bdat *bdatWriter
+    buffer []byte
+    c *smtp.Client
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Buffer the data, and send it when a chunk is filled.
+//////////////////////////////////////////////////////////////////////
+func (bw *bdatWriter) Write(p []byte) (int, error) {
+    n := 0
+    for len(p) > 0 {
+        m := bdatChunkSize - len(bw.buffer)
+        if m > len(p) {
+            m = len(p)
+        }
+        bw.buffer = append(bw.buffer, p[:m]...)
+        n += m
+        p = p[m:]
+        if len(bw.buffer) == bdatChunkSize {
+            if err := bw.send(false); err != nil {
+                return n, err
+            }
+        }
+    }
+    return n, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send the rest as the last chunk.
+//////////////////////////////////////////////////////////////////////
+func (bw *bdatWriter) Close() error {
+    return bw.send(true)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send the buffered data as a chunk.
+//////////////////////////////////////////////////////////////////////
+func (bw *bdatWriter) send(last bool) error {
+    cmd := "BDAT " + strconv.Itoa(len(bw.buffer))
+    if last {
+        cmd += " LAST"
+    }
+    id := bw.text.Next()
+    bw.text.StartRequest(id)
+    bw.text.W.WriteString(cmd + "\r\n")
+    bw.text.W.Write(bw.buffer)
+    err := bw.text.W.Flush()
+    bw.text.EndRequest(id)
+    if err != nil {
+        return fmt.Errorf("BDAT error. err=%w", err)
+    }
+    bw.text.StartResponse(id)
+    defer bw.text.EndResponse(id)
+    if _, _, err = bw.text.ReadResponse(250); err != nil {
+        return err
+    }
+    bw.buffer = bw.buffer[:0]
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Buffer the data up to bdatThreshold, and switch to BDAT beyond it.
+//////////////////////////////////////////////////////////////////////
+func (dw *dataOrBdatWriter) Write(p []byte) (int, error) {
+    if dw.bdat != nil {
+        return dw.bdat.Write(p)
+    }
+    if len(dw.buffer) + len(p) <= bdatThreshold {
+        dw.buffer = append(dw.buffer, p...)
+        return len(p), nil
+    }
+    dw.bdat = &bdatWriter{text: dw.c.Text}
+    if _, err := dw.bdat.Write(dw.buffer); err != nil {
+        return 0, err
+    }
+    dw.buffer = nil
+    return dw.bdat.Write(p)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send the rest as the last BDAT chunk, or the buffered data with DATA.
+//////////////////////////////////////////////////////////////////////
+func (dw *dataOrBdatWriter) Close() error {
+    if dw.bdat != nil {
+        return dw.bdat.Close()
+    }
+    wc, err := dw.c.Data()
+    if err != nil {
+        return err
+    }
+    if _, err = wc.Write(dw.buffer); err != nil {
+        wc.Close()
+        return err
+    }
+    return wc.Close()
+}
@@ -0,0 +1,110 @@
+//////////////////////////////////////////////////////////////////////
+// body.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "html"
+    "regexp"
+    "strings"
+)
+
+var htmlBodyTagRegexp = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+
+//////////////////////////////////////////////////////////////////////
+// Append a footer (e.g. address, unsubscribe link) to the body.
+// For HTML, the footer is wrapped in <div> and put before </body> if any.
+// For text, the footer is put on a new line.
+// The given body is not modified.
+//////////////////////////////////////////////////////////////////////
+func AppendFooter(body *Body, footer string) *Body {
+    b := *body
+    b.modified = b.modified || b.tmpl != nil
+    b.tmpl = nil
+    switch b.ContentType {
+    case CONTENT_TYPE_TEXT_HTML:
+        div := "<div>" + footer + "</div>"
+        if i := strings.LastIndex(strings.ToLower(b.Data), "</body>"); i >= 0 {
+            b.Data = b.Data[:i] + div + b.Data[i:]
+        } else {
+            b.Data += div
+        }
+    case CONTENT_TYPE_TEXT_PLAIN:
+        b.Data += "\n" + footer
+    default:
+        b.Data += footer
+    }
+    return &b
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Append the footer to the bodies of the same content type.
+//////////////////////////////////////////////////////////////////////
+func appendFooters(bodies []*Body, footer *Body) []*Body {
+    if footer == nil {
+        return bodies
+    }
+    result := make([]*Body, len(bodies))
+    for i, b := range bodies {
+        if b.ContentType == footer.ContentType {
+            result[i] = AppendFooter(b, footer.Data)
+        } else {
+            result[i] = b
+        }
+    }
+    return result
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Inject a preheader, the hidden text shown as the preview in inboxes,
+// at the top of <body> of the HTML body.
+// The given body is not modified.
+//////////////////////////////////////////////////////////////////////
+func InjectPreheader(body *Body, text string) (*Body, error) {
+    if body.ContentType != CONTENT_TYPE_TEXT_HTML {
+        return nil, errors.New("body is not HTML. contentType=" + body.ContentType)
+    }
+    b := *body
+    b.modified = b.modified || b.tmpl != nil
+    b.tmpl = nil
+    span := "<span style=\"display:none !important; visibility:hidden; mso-hide:all; font-size:1px; line-height:1px; max-height:0; max-width:0; opacity:0; overflow:hidden;\">" + html.EscapeString(text) + "</span>"
+    if loc := htmlBodyTagRegexp.FindStringIndex(b.Data); loc != nil {
+        b.Data = b.Data[:loc[1]] + span + b.Data[loc[1]:]
+    } else {
+        b.Data = span + b.Data
+    }
+    return &b, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the bodies to be composed, with the footer and the preheader.
+// Without bodies, an empty text body is composed for a headers-only message.
+//////////////////////////////////////////////////////////////////////
+func composeBodies(params *Params) []*Body {
+    bodies := params.Body
+    if len(bodies) == 0 {
+        bodies = []*Body{{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8}}
+    }
+    bodies = appendFooters(bodies, params.Footer)
+    if params.Preheader == "" {
+        return bodies
+    }
+    result := make([]*Body, len(bodies))
+    for i, b := range bodies {
+        if injected, err := InjectPreheader(b, params.Preheader); err == nil {
+            result[i] = injected
+        } else {
+            result[i] = b
+        }
+    }
+    return result
+}
@@ -0,0 +1,228 @@
+//////////////////////////////////////////////////////////////////////
+// builder.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     params, err := myMailer.NewMessage().
+//         Server("example.com", 465).
+//         From("noknow<noreply@example.com>").
+//         To("user@example.com").
+//         Cc("cc@example.com").
+//         Subject("This is a subject.").
+//         AddBody(textBody).
+//         AddBody(htmlBody).
+//         AddAttachment(attachment).
+//         Auth(authConfig).
+//         TlsConfig(tlsConfig).
+//         Build()
+//     if err != nil {
+//         // Error handling.
+//     }
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "crypto/tls"
+    "errors"
+    "net/mail"
+    "strconv"
+)
+
+type MessageBuilder struct {
+    params *Params
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate MessageBuilder Struct
+//////////////////////////////////////////////////////////////////////
+func NewMessage() *MessageBuilder {
+    return &MessageBuilder{
+        params: &Params{
+            Header: &Header{
+                MimeVersion: MIME_VERSION_1_0,
+            },
+        },
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set the SMTP server.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) Server(smtpServerHost string, smtpServerPort int) *MessageBuilder {
+    m.params.SmtpServerHost = smtpServerHost
+    m.params.SmtpServerPort = smtpServerPort
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set the authentication configuration.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) Auth(authConfig *AuthConfig) *MessageBuilder {
+    m.params.AuthConfig = authConfig
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set the TLS configuration.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) TlsConfig(tlsConfig *tls.Config) *MessageBuilder {
+    m.params.TlsConfig = tlsConfig
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set From.
+// Multiple addresses (e.g. "a@example.com, b@example.com") require Sender.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) From(from string) *MessageBuilder {
+    m.params.Header.From = from
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set Sender.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) Sender(sender string) *MessageBuilder {
+    m.params.Header.Sender = sender
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set To.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) To(to string) *MessageBuilder {
+    m.params.Header.To = to
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add Cc.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) Cc(cc ...string) *MessageBuilder {
+    m.params.Header.Cc = append(m.params.Header.Cc, cc...)
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add a group to To.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) ToGroup(name string, addresses ...string) *MessageBuilder {
+    m.params.Header.ToGroups = append(m.params.Header.ToGroups, GenGroup(name, addresses))
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add a group to Cc.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) CcGroup(name string, addresses ...string) *MessageBuilder {
+    m.params.Header.CcGroups = append(m.params.Header.CcGroups, GenGroup(name, addresses))
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add Bcc.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) Bcc(bcc ...string) *MessageBuilder {
+    m.params.Header.Bcc = append(m.params.Header.Bcc, bcc...)
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set Reply-To.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) ReplyTo(replyTo string) *MessageBuilder {
+    m.params.Header.ReplyTo = replyTo
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set Subject.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) Subject(subject string) *MessageBuilder {
+    m.params.Header.Subject = subject
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add a body.
+// If bodies are 2 or more, the last one is the preferred one according to RFC1341.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) AddBody(body *Body) *MessageBuilder {
+    m.params.Body = append(m.params.Body, body)
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add an attachment.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) AddAttachment(attachment *Attachment) *MessageBuilder {
+    m.params.Attachments = append(m.params.Attachments, attachment)
+    return m
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate and build Params Struct.
+//////////////////////////////////////////////////////////////////////
+func (m *MessageBuilder) Build() (*Params, error) {
+    header := m.params.Header
+    if header.From == "" {
+        return nil, errors.New("From is empty")
+    }
+    if len(recipients(header)) == 0 {
+        return nil, errors.New("recipients are empty")
+    }
+    // From may have multiple addresses, which require Sender (RFC5322).
+    from, err := mail.ParseAddressList(header.From)
+    if err != nil {
+        return nil, errors.New("mail.ParseAddressList() error. from=" + header.From + " err=" + err.Error())
+    }
+    if len(from) > 1 && header.Sender == "" {
+        return nil, errors.New("Sender is required for multiple From. from=" + strconv.Quote(header.From))
+    }
+    addrs := make([]string, 0)
+    if header.ReplyTo != "" {
+        addrs = append(addrs, header.ReplyTo)
+    }
+    if header.Sender != "" {
+        addrs = append(addrs, header.Sender)
+    }
+    addrs = append(addrs, recipients(header)...)
+    for _, addr := range addrs {
+        if _, err := mail.ParseAddress(addr); err != nil {
+            return nil, errors.New("mail.ParseAddress() error. address=" + addr + " err=" + err.Error())
+        }
+    }
+    for _, b := range m.params.Body {
+        if err := validateBody(b); err != nil {
+            return nil, err
+        }
+    }
+    for _, a := range m.params.Attachments {
+        if a == nil {
+            return nil, errors.New("Attachment is nil")
+        }
+    }
+    return m.params, nil
+}
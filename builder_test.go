@@ -0,0 +1,48 @@
+//////////////////////////////////////////////////////////////////////
+// builder_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "testing"
+)
+
+
+func TestMessageBuilderFrom(t *testing.T) {
+    tests := []struct {
+        name string
+        from string
+        sender string
+        wantErr bool
+    }{
+        {"single", "Alice <alice@example.com>", "", false},
+        {"multiple with sender", "Alice <alice@example.com>, bob@example.com", "alice@example.com", false},
+        {"multiple without sender", "Alice <alice@example.com>, bob@example.com", "", true},
+        {"invalid", "alice", "", true},
+        {"invalid sender", "Alice <alice@example.com>, bob@example.com", "alice", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params, err := NewMessage().
+                From(tt.from).
+                Sender(tt.sender).
+                To("to@example.com").
+                Subject("subject").
+                AddBody(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"}).
+                Build()
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Build() error=%v, wantErr %v", err, tt.wantErr)
+            }
+            // The built params compose as they are.
+            if err == nil {
+                if _, err = BuildMessage(params); err != nil {
+                    t.Errorf("BuildMessage() error. err=%v", err)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,100 @@
+//////////////////////////////////////////////////////////////////////
+// charset.go
+//
+// @usage
+//
+//     Body.Data is a UTF-8 string, and it is converted into Body.Charset
+//     per part when composing a message. UTF-8, US-ASCII and ISO-8859-1
+//     are built in. For the other charsets (e.g. ISO-2022-JP), register
+//     an encoder, e.g. with golang.org/x/text. Without it, only ASCII data
+//     (e.g. already encoded in ISO-2022-JP) can be sent.
+//
+//     --------------------------------------------------
+//     myMailer.RegisterCharsetEncoder(myMailer.CHARSET_ISO_2022_JP, func(s string) ([]byte, error) {
+//         return japanese.ISO2022JP.NewEncoder().Bytes([]byte(s))
+//     })
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+var (
+    charsetEncoders = map[string]func(string) ([]byte, error){
+        "iso-8859-1": encodeLatin1,
+        "us-ascii": encodeUsAscii,
+        "utf-8": func(s string) ([]byte, error) { return []byte(s), nil },
+    }
+    charsetEncodersMu sync.RWMutex
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Register an encoder converting UTF-8 into the charset.
+// Registering the same charset again replaces the encoder.
+//////////////////////////////////////////////////////////////////////
+func RegisterCharsetEncoder(charset string, encode func(s string) ([]byte, error)) {
+    charsetEncodersMu.Lock()
+    defer charsetEncodersMu.Unlock()
+    charsetEncoders[strings.ToLower(charset)] = encode
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Convert UTF-8 into the charset.
+// If no encoder is registered for the charset, ASCII data is returned as
+// it is, and non-ASCII data is an error rather than sent mislabelled.
+//////////////////////////////////////////////////////////////////////
+func encodeCharset(charset string, s string) ([]byte, error) {
+    charsetEncodersMu.RLock()
+    encode, ok := charsetEncoders[strings.ToLower(charset)]
+    charsetEncodersMu.RUnlock()
+    if !ok {
+        if _, err := encodeUsAscii(s); err != nil {
+            return nil, errors.New("no encoder is registered for the charset. charset=" + charset + ", err=" + err.Error())
+        }
+        return []byte(s), nil
+    }
+    b, err := encode(s)
+    if err != nil {
+        return nil, errors.New("charset conversion error. charset=" + charset + ", err=" + err.Error())
+    }
+    return b, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Convert UTF-8 into US-ASCII.
+//////////////////////////////////////////////////////////////////////
+func encodeUsAscii(s string) ([]byte, error) {
+    for i := 0; i < len(s); i++ {
+        if s[i] >= 0x80 {
+            return nil, errors.New("non-ASCII character. offset=" + strconv.Itoa(i))
+        }
+    }
+    return []byte(s), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Convert UTF-8 into ISO-8859-1.
+//////////////////////////////////////////////////////////////////////
+func encodeLatin1(s string) ([]byte, error) {
+    b := make([]byte, 0, len(s))
+    for i, r := range s {
+        if r > 0xff {
+            return nil, errors.New("character not in ISO-8859-1. offset=" + strconv.Itoa(i))
+        }
+        b = append(b, byte(r))
+    }
+    return b, nil
+}
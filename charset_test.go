@@ -0,0 +1,93 @@
+//////////////////////////////////////////////////////////////////////
+// charset_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+
+func TestEncodeCharset(t *testing.T) {
+    // An already encoded ISO-2022-JP text, which is 7bit.
+    iso2022jp := "\x1b$B$3$s$K$A$O\x1b(B"
+    tests := []struct {
+        name string
+        charset string
+        data string
+        want []byte
+        wantErr bool
+    }{
+        {"utf-8", CHARSET_UTF8, "café", []byte("café"), false},
+        {"utf-8 lower case", "utf-8", "日本", []byte("日本"), false},
+        {"us-ascii", CHARSET_US_ASCII, "hello", []byte("hello"), false},
+        {"us-ascii with non-ASCII", CHARSET_US_ASCII, "café", nil, true},
+        {"iso-8859-1", "ISO-8859-1", "café", []byte("caf\xe9"), false},
+        {"iso-8859-1 out of range", "iso-8859-1", "日本", nil, true},
+        {"iso-2022-jp without encoder", CHARSET_ISO_2022_JP, "こんにちは", nil, true},
+        {"iso-2022-jp already encoded", CHARSET_ISO_2022_JP, iso2022jp, []byte(iso2022jp), false},
+        {"unknown charset ASCII", "x-unknown", "hello", []byte("hello"), false},
+        {"unknown charset non-ASCII", "x-unknown", "café", nil, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := encodeCharset(tt.charset, tt.data)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("encodeCharset() error=%v, wantErr %v", err, tt.wantErr)
+            }
+            if !bytes.Equal(got, tt.want) {
+                t.Errorf("encodeCharset()=%q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+
+func TestRegisterCharsetEncoder(t *testing.T) {
+    const charset = "X-Test-Upper"
+    RegisterCharsetEncoder(charset, func(s string) ([]byte, error) {
+        return []byte(strings.ToUpper(s)), nil
+    })
+    t.Cleanup(func() {
+        charsetEncodersMu.Lock()
+        delete(charsetEncoders, strings.ToLower(charset))
+        charsetEncodersMu.Unlock()
+    })
+    got, err := encodeCharset("x-test-upper", "héllo")
+    if err != nil || string(got) != "HÉLLO" {
+        t.Errorf("encodeCharset()=%q, %v, want %q", got, err, "HÉLLO")
+    }
+}
+
+
+func TestBodyCharsetPerPart(t *testing.T) {
+    params := genTestParams(
+        &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: "iso-8859-1", Data: "café"},
+        &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_UTF8, Data: "<p>café</p>"},
+    )
+    b, err := BuildMessage(params)
+    if err != nil {
+        t.Fatalf("BuildMessage() error. err=%v", err)
+    }
+    if !bytes.Contains(b, []byte("\r\n\r\ncaf\xe9\r\n")) {
+        t.Errorf("text part is not in ISO-8859-1. message=%q", b)
+    }
+    if !bytes.Contains(b, []byte("<p>café</p>")) {
+        t.Errorf("HTML part is not in UTF-8. message=%q", b)
+    }
+
+    // Non-ASCII can not be sent in a charset without an encoder.
+    params = genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_ISO_2022_JP, Data: "こんにちは"})
+    if _, err = BuildMessage(params); err == nil {
+        t.Error("BuildMessage() succeeded for non-ASCII ISO-2022-JP without an encoder")
+    }
+    if err = params.Validate(); err == nil {
+        t.Error("Validate() succeeded for non-ASCII ISO-2022-JP without an encoder")
+    }
+}
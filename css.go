@@ -0,0 +1,309 @@
+//////////////////////////////////////////////////////////////////////
+// css.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     htmlBody, err = myMailer.InlineCSS(htmlBody)
+//     if err != nil {
+//         // Error handling.
+//     }
+//     --------------------------------------------------
+//
+//     Supported selectors are type, class, ID, universal selectors and
+//     their compounds (e.g. "td", ".btn", "#header", "a.btn.primary", "*").
+//     Rules which can not be inlined (e.g. @media, :hover, "table td") are
+//     kept in a <style> block.
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "html"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+type cssRule struct {
+    declarations []*cssDeclaration
+    order int
+    selector *cssSelector
+    specificity int
+}
+
+type cssDeclaration struct {
+    property string
+    value string
+}
+
+type cssSelector struct {
+    classes []string
+    id string
+    tag string
+}
+
+var (
+    cssCommentRegexp = regexp.MustCompile(`(?s)/\*.*?\*/`)
+    cssSelectorRegexp = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9-]*|\*)?((?:[.#][a-zA-Z0-9_-]+)*)$`)
+    htmlAttrRegexp = regexp.MustCompile(`([^\s=/>]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s>]+))?`)
+    htmlStartTagRegexp = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9-]*)((?:\s+[^\s=/>]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>]+))?)*)\s*(/?)>`)
+    htmlStyleRegexp = regexp.MustCompile(`(?is)<style[^>]*>(.*?)</style>`)
+    // Elements never rendered in the body.
+    nonBodyTags = map[string]bool{"html": true, "head": true, "title": true, "meta": true, "link": true, "style": true, "script": true, "base": true}
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Inline the CSS in <style> blocks into style attributes of the matching
+// elements, since many email clients strip <style> blocks.
+// The declarations in the existing style attributes take precedence.
+//////////////////////////////////////////////////////////////////////
+func InlineCSS(htmlBody *Body) (*Body, error) {
+    if htmlBody.ContentType != CONTENT_TYPE_TEXT_HTML {
+        return nil, errors.New("body is not HTML. contentType=" + htmlBody.ContentType)
+    }
+    rules := make([]*cssRule, 0)
+    residual := ""
+    var parseErr error
+    data := htmlStyleRegexp.ReplaceAllStringFunc(htmlBody.Data, func(style string) string {
+        css := htmlStyleRegexp.FindStringSubmatch(style)[1]
+        r, rest, err := parseCss(css, len(rules))
+        if err != nil {
+            parseErr = err
+            return style
+        }
+        rules = append(rules, r...)
+        residual += rest
+        return ""
+    })
+    if parseErr != nil {
+        return nil, parseErr
+    }
+    sort.SliceStable(rules, func(i, j int) bool {
+        if rules[i].specificity != rules[j].specificity {
+            return rules[i].specificity < rules[j].specificity
+        }
+        return rules[i].order < rules[j].order
+    })
+    data = htmlStartTagRegexp.ReplaceAllStringFunc(data, func(tag string) string {
+        return inlineTag(tag, rules)
+    })
+    if residual != "" {
+        style := "<style type=\"text/css\">\n" + residual + "</style>"
+        if i := strings.Index(strings.ToLower(data), "</head>"); i >= 0 {
+            data = data[:i] + style + data[i:]
+        } else {
+            data = style + data
+        }
+    }
+    b := *htmlBody
+    b.Data = data
+    b.modified = b.modified || b.tmpl != nil
+    b.tmpl = nil
+    return &b, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Parse CSS into the rules which can be inlined and the rest.
+//////////////////////////////////////////////////////////////////////
+func parseCss(css string, order int) ([]*cssRule, string, error) {
+    css = cssCommentRegexp.ReplaceAllString(css, "")
+    rules := make([]*cssRule, 0)
+    residual := ""
+    for {
+        open := strings.Index(css, "{")
+        if open < 0 {
+            if strings.TrimSpace(css) != "" {
+                return nil, "", errors.New("invalid CSS. css=" + strings.TrimSpace(css))
+            }
+            break
+        }
+        depth := 0
+        end := -1
+        for i := open; i < len(css); i++ {
+            if css[i] == '{' {
+                depth++
+            } else if css[i] == '}' {
+                depth--
+                if depth == 0 {
+                    end = i
+                    break
+                }
+            }
+        }
+        if end < 0 {
+            return nil, "", errors.New("invalid CSS. unclosed block")
+        }
+        prelude := strings.TrimSpace(css[:open])
+        block := css[open + 1:end]
+        css = css[end + 1:]
+        if strings.HasPrefix(prelude, "@") {
+            residual += prelude + " {" + block + "}\n"
+            continue
+        }
+        declarations := parseCssDeclarations(block)
+        for _, s := range strings.Split(prelude, ",") {
+            s = strings.TrimSpace(s)
+            selector := parseCssSelector(s)
+            if selector == nil {
+                residual += s + " {" + block + "}\n"
+                continue
+            }
+            specificity := len(selector.classes) * 100
+            if selector.id != "" {
+                specificity += 10000
+            }
+            if selector.tag != "" {
+                specificity++
+            }
+            rules = append(rules, &cssRule{
+                declarations: declarations,
+                order: order,
+                selector: selector,
+                specificity: specificity,
+            })
+            order++
+        }
+    }
+    return rules, residual, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Parse CSS declarations (e.g. "color: red; margin: 0").
+//////////////////////////////////////////////////////////////////////
+func parseCssDeclarations(block string) []*cssDeclaration {
+    declarations := make([]*cssDeclaration, 0)
+    for _, d := range strings.Split(block, ";") {
+        kv := strings.SplitN(d, ":", 2)
+        if len(kv) != 2 {
+            continue
+        }
+        property := strings.ToLower(strings.TrimSpace(kv[0]))
+        value := strings.TrimSpace(kv[1])
+        if property == "" || value == "" {
+            continue
+        }
+        declarations = append(declarations, &cssDeclaration{property: property, value: value})
+    }
+    return declarations
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Parse a compound selector.
+// Returns nil if the selector is not supported.
+//////////////////////////////////////////////////////////////////////
+func parseCssSelector(s string) *cssSelector {
+    m := cssSelectorRegexp.FindStringSubmatch(s)
+    if m == nil || s == "" {
+        return nil
+    }
+    selector := &cssSelector{}
+    if m[1] != "*" {
+        selector.tag = strings.ToLower(m[1])
+    }
+    rest := m[2]
+    for rest != "" {
+        next := strings.IndexAny(rest[1:], ".#") + 1
+        if next == 0 {
+            next = len(rest)
+        }
+        if rest[0] == '#' {
+            selector.id = rest[1:next]
+        } else {
+            selector.classes = append(selector.classes, rest[1:next])
+        }
+        rest = rest[next:]
+    }
+    return selector
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Inline the matching rules into a start tag.
+//////////////////////////////////////////////////////////////////////
+func inlineTag(tag string, rules []*cssRule) string {
+    m := htmlStartTagRegexp.FindStringSubmatch(tag)
+    name := strings.ToLower(m[1])
+    if nonBodyTags[name] {
+        return tag
+    }
+    attrs := htmlAttrRegexp.FindAllStringSubmatch(m[2], -1)
+    var id, style string
+    var classes []string
+    for _, a := range attrs {
+        value := html.UnescapeString(strings.Trim(a[2], `"'`))
+        switch strings.ToLower(a[1]) {
+        case "id":
+            id = value
+        case "class":
+            classes = strings.Fields(value)
+        case "style":
+            style = value
+        }
+    }
+    properties := make([]string, 0)
+    values := make(map[string]string)
+    set := func(declarations []*cssDeclaration) {
+        for _, d := range declarations {
+            if _, ok := values[d.property]; !ok {
+                properties = append(properties, d.property)
+            }
+            values[d.property] = d.value
+        }
+    }
+    for _, r := range rules {
+        if r.selector.matches(name, id, classes) {
+            set(r.declarations)
+        }
+    }
+    if len(properties) == 0 {
+        return tag
+    }
+    set(parseCssDeclarations(style))
+    declarations := make([]string, 0, len(properties))
+    for _, p := range properties {
+        declarations = append(declarations, p + ": " + values[p])
+    }
+    newAttrs := ""
+    for _, a := range attrs {
+        if strings.ToLower(a[1]) != "style" {
+            newAttrs += " " + a[0]
+        }
+    }
+    newAttrs += " style=\"" + html.EscapeString(strings.Join(declarations, "; ") + ";") + "\""
+    return "<" + m[1] + newAttrs + m[3] + ">"
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the selector matches the element.
+//////////////////////////////////////////////////////////////////////
+func (s *cssSelector) matches(tag string, id string, classes []string) bool {
+    if s.tag != "" && s.tag != tag {
+        return false
+    }
+    if s.id != "" && s.id != id {
+        return false
+    }
+    for _, c := range s.classes {
+        found := false
+        for _, cc := range classes {
+            if c == cc {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
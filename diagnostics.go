@@ -0,0 +1,201 @@
+//////////////////////////////////////////////////////////////////////
+// diagnostics.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     capabilities, err := myMailer.ServerCapabilities(smtpServerHost, smtpServerPort, tlsConfig)
+//     if err != nil {
+//         // Error handling.
+//     }
+//     if mechanisms, ok := capabilities["AUTH"]; ok {
+//         // e.g.) "PLAIN LOGIN CRAM-MD5"
+//     }
+//     --------------------------------------------------
+//
+//     --------------------------------------------------
+//     transport, err := myMailer.ProbeTransport(smtpServerHost, smtpServerPort, 10 * time.Second)
+//     if err != nil {
+//         // Error handling.
+//     }
+//     switch transport {
+//     case myMailer.TRANSPORT_SMTPS:
+//         params.TlsConfig = myMailer.GenTlsConfig(smtpServerHost)
+//     case myMailer.TRANSPORT_STARTTLS:
+//         params.StartTls = true
+//     }
+//     --------------------------------------------------
+//
+//     --------------------------------------------------
+//     cert, err := myMailer.VerifyTLS(params)
+//     if cert == nil {
+//         // Connection error handling.
+//     } else if err != nil {
+//         // e.g.) x509: certificate signed by unknown authority
+//         // The certificate is returned for inspection (cert.Issuer, cert.NotAfter, etc.)
+//     }
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "net"
+    "net/textproto"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type TransportType string
+
+const (
+    TRANSPORT_PLAIN TransportType = "plain"
+    TRANSPORT_SMTPS TransportType = "smtps"
+    TRANSPORT_STARTTLS TransportType = "starttls"
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the extensions advertised by the server in response to EHLO.
+// The keys are the upper-cased extension names (e.g. "AUTH", "SIZE",
+// "STARTTLS", "8BITMIME"), and the values are their parameters.
+// If the TLS config is given, implicit TLS is used.
+//////////////////////////////////////////////////////////////////////
+func ServerCapabilities(smtpHost string, port int, tlsConfig *tls.Config) (map[string]string, error) {
+    addr := smtpHost + ":" + strconv.Itoa(port)
+    var conn net.Conn
+    var err error
+    if tlsConfig != nil {
+        conn, err = tls.Dial("tcp", addr, tlsConfig)
+        if err != nil {
+            return nil, errors.New("tls.Dial() error. err=" + err.Error())
+        }
+    } else {
+        conn, err = net.Dial("tcp", addr)
+        if err != nil {
+            return nil, errors.New("net.Dial() error. err=" + err.Error())
+        }
+    }
+    text := textproto.NewConn(conn)
+    defer text.Close()
+    return ehloCapabilities(text)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Read the greeting, send EHLO and parse the extensions, then QUIT.
+//////////////////////////////////////////////////////////////////////
+func ehloCapabilities(text *textproto.Conn) (map[string]string, error) {
+    if _, _, err := text.ReadResponse(220); err != nil {
+        return nil, errors.New("(*textproto.Conn) ReadResponse() error. err=" + err.Error())
+    }
+    msg, err := textCmd(text, 250, "EHLO localhost")
+    if err != nil {
+        return nil, errors.New("EHLO error. err=" + err.Error())
+    }
+    capabilities := make(map[string]string)
+    lines := strings.Split(msg, "\n")
+    for _, line := range lines[1:] {
+        args := strings.SplitN(line, " ", 2)
+        if len(args) > 1 {
+            capabilities[strings.ToUpper(args[0])] = args[1]
+        } else {
+            capabilities[strings.ToUpper(args[0])] = ""
+        }
+    }
+    textCmd(text, 221, "QUIT")
+    return capabilities, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Detect the transport of the server, so that the mode does not have to
+// be known in advance.
+// The implicit TLS handshake is tried first, and then EHLO in plaintext
+// to check if STARTTLS is advertised. The certificate is not verified
+// here, which VerifyTLS() does.
+//////////////////////////////////////////////////////////////////////
+func ProbeTransport(host string, port int, timeout time.Duration) (TransportType, error) {
+    addr := net.JoinHostPort(host, strconv.Itoa(port))
+    dialer := &net.Dialer{Timeout: timeout}
+    tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: true}
+    if conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig); err == nil {
+        conn.Close()
+        return TRANSPORT_SMTPS, nil
+    }
+    conn, err := dialer.Dial("tcp", addr)
+    if err != nil {
+        return "", errors.New("net.Dial() error. err=" + err.Error())
+    }
+    if timeout > 0 {
+        conn.SetDeadline(time.Now().Add(timeout))
+    }
+    text := textproto.NewConn(conn)
+    defer text.Close()
+    capabilities, err := ehloCapabilities(text)
+    if err != nil {
+        return "", err
+    }
+    if _, ok := capabilities["STARTTLS"]; ok {
+        return TRANSPORT_STARTTLS, nil
+    }
+    return TRANSPORT_PLAIN, nil
+}
+
+
+
+//////////////////////////////////////////////////////////////////////
+// Perform the TLS handshake with the server and verify the certificate
+// chain against the TlsConfig (ServerName and RootCAs).
+// The leaf certificate is returned with the verification error, if the
+// handshake succeeds. If StartTls is false, implicit TLS is used.
+//////////////////////////////////////////////////////////////////////
+func VerifyTLS(params *Params) (*x509.Certificate, error) {
+    _, _, host := serverAddr(params)
+    var tlsConfig *tls.Config
+    if params.TlsConfig != nil {
+        tlsConfig = params.TlsConfig.Clone()
+    } else {
+        tlsConfig = GenTlsConfig(host)
+    }
+    serverName := tlsConfig.ServerName
+    if serverName == "" {
+        serverName = host
+    }
+    // The certificate is verified below, so that it can be returned even if it is invalid.
+    tlsConfig.InsecureSkipVerify = true
+    p := *params
+    p.Conn = nil
+    p.TlsConfig = tlsConfig
+    c, err := dial(&p)
+    if err != nil {
+        return nil, err
+    }
+    defer c.Close()
+    state, ok := c.TLSConnectionState()
+    if !ok || len(state.PeerCertificates) == 0 {
+        return nil, errors.New("no peer certificate")
+    }
+    c.Quit()
+    leaf := state.PeerCertificates[0]
+    intermediates := x509.NewCertPool()
+    for _, cert := range state.PeerCertificates[1:] {
+        intermediates.AddCert(cert)
+    }
+    _, err = leaf.Verify(x509.VerifyOptions{
+        DNSName: serverName,
+        Intermediates: intermediates,
+        Roots: tlsConfig.RootCAs,
+    })
+    if err != nil {
+        return leaf, errors.New("(*Certificate) Verify() error. err=" + err.Error())
+    }
+    return leaf, nil
+}
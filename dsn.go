@@ -0,0 +1,113 @@
+//////////////////////////////////////////////////////////////////////
+// dsn.go
+//
+// @usage
+//
+//     Request Delivery Status Notifications (RFC3461).
+//     Send fails if the server does not support DSN.
+//
+//     --------------------------------------------------
+//     params.Dsn = myMailer.GenDsn(
+//         []string{myMailer.DSN_NOTIFY_FAILURE, myMailer.DSN_NOTIFY_DELAY},
+//         myMailer.DSN_RETURN_HDRS,
+//         "order-12345",
+//     )
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "strconv"
+    "strings"
+)
+
+const (
+    DSN_NOTIFY_DELAY = "DELAY"
+    DSN_NOTIFY_FAILURE = "FAILURE"
+    DSN_NOTIFY_NEVER = "NEVER"
+    DSN_NOTIFY_SUCCESS = "SUCCESS"
+    DSN_RETURN_FULL = "FULL"
+    DSN_RETURN_HDRS = "HDRS"
+)
+
+type Dsn struct {
+    EnvID string  // (Optional) Envelope ID returned in the notifications.
+    Notify []string  // (Optional) NOTIFY of each recipient. NEVER must be alone.
+    Return string  // (Optional) RET, which is FULL or HDRS.
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Dsn Struct
+//////////////////////////////////////////////////////////////////////
+func GenDsn(notify []string, ret string, envID string) *Dsn {
+    return &Dsn{
+        EnvID: envID,
+        Notify: notify,
+        Return: ret,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate the DSN parameters.
+//////////////////////////////////////////////////////////////////////
+func (d *Dsn) validate() error {
+    for _, n := range d.Notify {
+        switch n {
+        case DSN_NOTIFY_SUCCESS, DSN_NOTIFY_FAILURE, DSN_NOTIFY_DELAY:
+        case DSN_NOTIFY_NEVER:
+            if len(d.Notify) > 1 {
+                return errors.New("NEVER must not be combined with other notify values. notify=" + strings.Join(d.Notify, ","))
+            }
+        default:
+            return errors.New("invalid DSN notify. notify=" + strconv.Quote(n))
+        }
+    }
+    switch d.Return {
+    case "", DSN_RETURN_FULL, DSN_RETURN_HDRS:
+    default:
+        return errors.New("invalid DSN return. return=" + strconv.Quote(d.Return))
+    }
+    if len(d.EnvID) > 100 {
+        return errors.New("DSN envelope ID is too long. envID=" + strconv.Quote(d.EnvID))
+    }
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the MAIL FROM parameters.
+//////////////////////////////////////////////////////////////////////
+func (d *Dsn) mailParams() map[string]string {
+    mailParams := make(map[string]string)
+    if d.Return != "" {
+        mailParams["RET"] = d.Return
+    }
+    if d.EnvID != "" {
+        mailParams["ENVID"] = xtext(d.EnvID)
+    }
+    return mailParams
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Encode the string into xtext (RFC3461).
+//////////////////////////////////////////////////////////////////////
+func xtext(s string) string {
+    encoded := ""
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if c < 33 || c > 126 || c == '+' || c == '=' {
+            encoded += "+" + strings.ToUpper(strconv.FormatInt(int64(c) + 0x100, 16)[1:])
+        } else {
+            encoded += string(c)
+        }
+    }
+    return encoded
+}
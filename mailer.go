@@ -152,6 +152,29 @@
 //         )
 //         --------------------------------------------------
 //
+//         7-A. (Optional) Attach files.
+//
+//             --------------------------------------------------
+//             attachment, err := myMailer.GenAttachmentFromFile("invoice.pdf", "application/pdf")
+//             if err != nil {
+//                 // Error handling.
+//             }
+//
+//             // When sending the same attachment many times, encode it once beforehand.
+//             if err := attachment.Encode(); err != nil {
+//                 // Error handling.
+//             }
+//             params.Attachments = []*myMailer.Attachment{attachment}
+//             --------------------------------------------------
+//
+//         7-B. (Optional) Embed images referred as <img src="cid:logo"> in the HTML body.
+//
+//             --------------------------------------------------
+//             params.InlineImages = []*myMailer.InlineImage{
+//                 myMailer.GenInlineImage("logo", "logo.png", "image/png", logoData),
+//             }
+//             --------------------------------------------------
+//
 //     8. Send an email.
 //
 //         --------------------------------------------------
@@ -160,6 +183,26 @@
 //         }
 //         --------------------------------------------------
 //
+//         8-A. (Optional) Write the message into an io.Writer instead of sending it.
+//
+//             --------------------------------------------------
+//             cmd := exec.Command("/usr/sbin/sendmail", "-t")
+//             stdin, err := cmd.StdinPipe()
+//             if err != nil {
+//                 // Error handling.
+//             }
+//             if err := cmd.Start(); err != nil {
+//                 // Error handling.
+//             }
+//             if err := myMailer.WriteMessage(stdin, params); err != nil {
+//                 // Error handling.
+//             }
+//             stdin.Close()
+//             if err := cmd.Wait(); err != nil {
+//                 // Error handling.
+//             }
+//             --------------------------------------------------
+//
 //
 // MIT License
 //
@@ -186,48 +229,182 @@ package mailer
 
 import (
     "bytes"
+    "compress/gzip"
+    crand "crypto/rand"
     "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
     "errors"
+    "fmt"
     "html/template"
-    "math/rand"
+    "io"
+    "io/fs"
+    "log"
+    "mime"
+    "net"
+    "net/mail"
+    "net/textproto"
     "net/smtp"
+    "os"
     "path"
+    "regexp"
+    "sort"
     "strconv"
+    "strings"
+    texttemplate "text/template"
     "time"
 )
 
 const (
+    AUTH_METHOD_CRAM_MD5 AuthMethod = "CRAM-MD5"
+    AUTH_METHOD_PLAIN AuthMethod = "PLAIN"
+    AUTH_METHOD_SCRAM_SHA_256 AuthMethod = "SCRAM-SHA-256"
+    AUTO_RESPONSE_SUPPRESS_ALL = "All"
+    AUTO_RESPONSE_SUPPRESS_DR = "DR"
+    AUTO_RESPONSE_SUPPRESS_NDR = "NDR"
+    AUTO_RESPONSE_SUPPRESS_OOF = "OOF"
+    AUTO_SUBMITTED_AUTO_GENERATED = "auto-generated"
+    AUTO_SUBMITTED_AUTO_REPLIED = "auto-replied"
     CHARSET_ISO_2022_JP = "iso-2022-jp"
     CHARSET_US_ASCII = "us-ascii"
     CHARSET_UTF8 = "UTF-8"
+    CONTENT_TYPE_APPLICATION_GZIP = "application/gzip"
+    CONTENT_TYPE_APPLICATION_OCTET_STREAM = "application/octet-stream"
+    CONTENT_TYPE_MESSAGE_RFC822 = "message/rfc822"
+    CONTENT_TYPE_TEXT_CALENDAR = "text/calendar"
     CONTENT_TYPE_TEXT_HTML = "text/html"
     CONTENT_TYPE_TEXT_PLAIN = "text/plain"
     CONTENT_TYPE_TEXT_RICHTEXT = "text/richtext"
     CONTENT_TYPE_TEXT_X_WHATEVER = "text/x-whatever"
     MIME_VERSION_1_0 = "1.0"
+    PRIORITY_HIGH = "high"
+    PRIORITY_LOW = "low"
+    PRIORITY_NORMAL = "normal"
+    SUBJECT_ENCODING_AUTO = ""
+    SUBJECT_ENCODING_B = "B"
+    SUBJECT_ENCODING_Q = "Q"
+    TRANSFER_ENCODING_7BIT = "7bit"
+    TRANSFER_ENCODING_8BIT = "8bit"
+    TRANSFER_ENCODING_BASE64 = "base64"
+    TRANSFER_ENCODING_BINARY = "binary"
+    TRANSFER_ENCODING_QUOTED_PRINTABLE = "quoted-printable"
+    UNDISCLOSED_RECIPIENTS = "undisclosed-recipients:;"
+    VERSION = "1.0.0"
+)
+
+type templateOptions struct {
+    leftDelim string
+    noRawHTML bool
+    rightDelim string
+    strict bool
+}
+
+var (
+    defaultCharset = CHARSET_UTF8
+    defaultContentType = CONTENT_TYPE_TEXT_PLAIN
+    defaultXMailer = false
+    // The values of Importance, X-Priority and X-MSMail-Priority headers.
+    priorityHeaders = map[string][3]string{
+        PRIORITY_HIGH: {"high", "1 (Highest)", "High"},
+        PRIORITY_LOW: {"low", "5 (Lowest)", "Low"},
+        PRIORITY_NORMAL: {"normal", "3 (Normal)", "Normal"},
+    }
+    idempotencyKeyHeader = "X-Idempotency-Key"
+    // The extensions required by the MAIL FROM parameters other than the same name.
+    mailParamExtensions = map[string]string{
+        "BY": "DELIVERBY",
+        "ENVID": "DSN",
+        "HOLDFOR": "FUTURERELEASE",
+        "HOLDUNTIL": "FUTURERELEASE",
+        "RET": "DSN",
+    }
+    // BCP47 language tag syntax, e.g. "en", "en-US", "zh-Hant-TW", "x-klingon".
+    languageTagRegexp = regexp.MustCompile(`^(?:[a-zA-Z]{2,8}|[xX])(?:-[a-zA-Z0-9]{1,8})*$`)
+    strictTemplate = false
+    utf8Bom = []byte{0xef, 0xbb, 0xbf}
 )
 
 type Params struct {
+    AllowInsecureAuth bool  // Allow plaintext credentials over an unencrypted connection, e.g. closed test networks.
+    Attachments []*Attachment
     AuthConfig *AuthConfig
     Body []*Body
+    BoundaryGenerator func() string  // (Optional) Generate MIME boundaries, e.g. deterministic ones for tests.
+    Conn net.Conn  // (Optional) Pre-established connection used instead of dialing. Not for Pool, which dials each connection.
+    Dsn *Dsn  // (Optional) Request Delivery Status Notifications.
+    EnforceFromMatch bool  // Require From to match the PLAIN auth user name before dialing.
+    EnvelopeFrom string  // (Optional) MAIL FROM (the return path). Defaults to From, or Sender for multiple From.
+    Footer *Body  // (Optional) Appended to the bodies of the same content type.
     Header *Header
-    SmtpServerHost string
+    InlineImages []*InlineImage  // (Optional) Images referred from HTML bodies by "cid:".
+    MailParams map[string]string  // (Optional) Extra MAIL FROM parameters (e.g. "RET": "HDRS"), skipped if the server does not support.
+    Metrics Metrics  // (Optional) Receive the durations of the phases of sending.
+    Network string  // (Optional) Network to dial, e.g. "tcp4" or "tcp6" to force IPv4 or IPv6. Defaults to "tcp".
+    PgpConfig *PgpConfig  // (Optional) Encrypt the content as PGP/MIME.
+    Preheader string  // (Optional) Hidden preview text injected into HTML bodies.
+    SmtpServerHost string  // Host name, or "unix:" + socket path for a Unix domain socket.
     SmtpServerPort int
-    TlsConfig *tls.Config
+    StartTls bool  // Use TlsConfig for STARTTLS instead of implicit TLS.
+    Timeout time.Duration  // (Optional) Timeout for connecting, the greeting and STARTTLS. 0 means no timeout.
+    TlsConfig *tls.Config  // (Optional) The certificate is verified against ServerName, which may differ from SmtpServerHost.
+    rawHeader string  // Written instead of the generated headers if not empty.
+    strictRcpt bool  // Try all recipients, and fail if any is rejected.
 }
 
 type Header struct {
+    AutoResponseSuppress string  // (Optional) X-Auto-Response-Suppress header for Exchange, e.g. AUTO_RESPONSE_SUPPRESS_ALL. Values may be comma-joined.
+    AutoSubmitted string  // (Optional) Auto-Submitted header (RFC3834). Unset means manual.
+    Bcc []string
+    Cc []string
+    CcGroups []*Group
+    Comments string  // (Optional) Comments header. Non-ASCII is encoded in RFC2047.
+    Date time.Time  // (Optional) Date header. Defaults to the time of composing the message.
+    DeferUntil time.Time  // (Optional) Deferred-Delivery header for relays honoring it. It does not delay sending.
+    ExpiryDate time.Time  // (Optional) Expiry-Date header (RFC2156), e.g. for one-time codes. It must be in the future.
+    ExtraHeaders []*HeaderField  // (Optional) Written after the generated headers in order, e.g. trace headers.
     From string
-    MimeVersion string
+    IdempotencyKey string  // (Optional) Key for the provider to suppress duplicates. See SetIdempotencyKeyHeader().
+    InReplyTo string  // (Optional) Message-ID replied to, e.g. "<abc@example.com>". Angle brackets may be omitted.
+    Keywords []string  // (Optional) Keywords header, comma-joined. Non-ASCII is encoded in RFC2047 per keyword.
+    MessageID string  // (Optional) Message-ID header, e.g. "<abc@example.com>". Generated with the From domain if empty.
+    MimeVersion string  // Written only if the message uses MIME features (e.g. multipart, a charset other than us-ascii, non-7bit). Defaults to "1.0".
+    Organization string  // (Optional) Organization header. Non-ASCII is encoded in RFC2047.
+    Priority string  // (Optional) PRIORITY_HIGH, PRIORITY_NORMAL or PRIORITY_LOW, written as Importance, X-Priority and X-MSMail-Priority.
+    References []string  // (Optional) Message-IDs of the thread.
+    ReplyTo string
+    Sender string  // (Optional) Sender header, a single address sending on behalf of From. Written only if it differs from From.
     Subject string
+    SubjectEncoding string  // (Optional) RFC2047 encoding of non-ASCII Subject, SUBJECT_ENCODING_Q or SUBJECT_ENCODING_B. Defaults to the shorter one.
     To string
+    ToGroups []*Group
+    XMailer string  // (Optional) X-Mailer header. See SetDefaultXMailer().
+}
+
+// Header field written as it is.
+type HeaderField struct {
+    Name string
+    Value string
+}
+
+// Address group defined in RFC5322 (e.g. "Team: a@example.com, b@example.com;").
+type Group struct {
+    Addresses []string
+    Name string
 }
 
 type AuthConfig struct {
+    Auth smtp.Auth  // (Optional) Custom auth (e.g. another SASL mechanism) used instead of the others.
+    // (Optional) Methods tried in order until one succeeds. Unconfigured or
+    // unadvertised methods are skipped.
+    // NOTE: Falling back to PLAIN sends the password as it is, so use it only over TLS.
+    AuthFallback []AuthMethod
     Crammd5Auth *CRAMMD5Auth
     PlainAuth *PlainAuth
+    ScramSha256Auth *ScramSha256Auth
 }
 
+type AuthMethod string
+
 type CRAMMD5Auth struct {
     UserName string
     Secret string
@@ -239,259 +416,1990 @@ type PlainAuth struct {
     Host string
 }
 
+// SCRAM-SHA-256 authentication (RFC7677), which also implements smtp.Auth.
+type ScramSha256Auth struct {
+    UserName string
+    Password string
+    Host string
+    authMessage string
+    clientFirstBare string
+    nonce string
+    serverSignature []byte
+}
+
 type Body struct {
+    AutoEncode bool  // Encode Data with quoted-printable or base64 as needed if TransferEncoding is empty.
+    ContentLanguage string  // (Optional) Language tags (BCP47) of Data, e.g. "en" or "en-US, ja".
     ContentType string
     Charset string
     Data string
+    Description string  // (Optional) Content-Description header.
+    Method string  // (Optional) iCalendar method of text/calendar (e.g. "REQUEST", "CANCEL").
+    TransferEncoding string
+    modified bool  // Whether Data rendered from a template has been modified, e.g. by InlineCSS(), and can not be rendered again.
+    textOf *Body  // The HTML body Data was converted from, if any.
+    tmpl *template.Template  // The template Data was rendered from, if any.
+    tmplName string
+}
+
+// Error replied by the SMTP server.
+type SMTPError struct {
+    Code int
+    Command string
+    Message string
+}
+
+// Error of the recipients rejected by the server.
+type RecipientsError struct {
+    Rejected []*RejectedRecipient
+}
+
+type RejectedRecipient struct {
+    Address string
+    Code int
+    Message string
+}
+
+type Attachment struct {
+    ContentType string
+    Data []byte
+    Description string  // (Optional) Content-Description header.
+    FileName string
+    Gzip bool  // Compress Data with gzip, and send it as FileName + ".gz" in application/gzip and base64.
+    Inline bool  // Content-Disposition inline instead of attachment.
+    TransferEncoding string  // (Optional) Defaults to quoted-printable for text/*, or else base64. Ignored with Gzip.
+    encoded string
+    encodedAs string
+    reader io.Reader  // Streamed instead of Data. See AttachReader().
+    readerSize int64
+}
+
+type InlineImage struct {
+    ContentID string
+    ContentType string
+    Data []byte
+    Description string  // (Optional) Content-Description header, e.g. alternative text.
+    FileName string
 }
 
 //////////////////////////////////////////////////////////////////////
 // Send Email
 //////////////////////////////////////////////////////////////////////
 func Send(params *Params) error {
+    _, err := send(params)
+    return err
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send Email, and return whether the message has been accepted.
+// The message may be accepted even if an error is returned, e.g. on QUIT.
+//////////////////////////////////////////////////////////////////////
+func send(params *Params) (bool, error) {
+    c, err := SendAndReturnClient(params)
+    if err != nil {
+        return false, err
+    }
+    defer c.Close()
+    if err = c.Quit(); err != nil {
+        return true, smtpError("(*Client) Quit()", err)
+    }
+    return true, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send Email with the raw header block instead of the generated one.
+// The content (bodies and attachments) is composed by this package, so
+// the raw header must not have Content-Type or Content-Transfer-Encoding.
+// The envelope is still taken from params.Header.
+//////////////////////////////////////////////////////////////////////
+func SendWithRawHeader(params *Params, rawHeader string) error {
+    header, err := normalizeRawHeader(rawHeader)
+    if err != nil {
+        return err
+    }
+    p := *params
+    p.rawHeader = header
+    return Send(&p)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send Email only if all of the recipients are accepted.
+// Unlike Send, which stops at the first rejected recipient, RCPT is sent
+// for all of them, and *RecipientsError listing every rejected one is
+// returned before DATA.
+//////////////////////////////////////////////////////////////////////
+func SendStrict(params *Params) error {
+    p := *params
+    p.strictRcpt = true
+    return Send(&p)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send Email, and return the client without QUIT.
+// The caller is responsible for calling Quit() or Close() on the client.
+// e.g.) Inspecting a test server after DATA.
+//////////////////////////////////////////////////////////////////////
+func SendAndReturnClient(params *Params) (*smtp.Client, error) {
+    start := time.Now()
+
+    if err := params.Validate(); err != nil {
+        return nil, err
+    }
+
     // Set up headers and message.
-    headers := make(map[string]string)
-    headers["From"] = params.Header.From
-    headers["To"] = params.Header.To
-    headers["Subject"] = params.Header.Subject
-    headers["MIME-version"] = params.Header.MimeVersion
-    body := make([]byte, 0)
-    for k,v := range headers {
-        body = append(body, k + ": " + v + "\r\n"...)
-    }
-    var boundary string
-    if len(params.Body) > 1 {
-        boundary = genBoundary()
-        body = append(body, "Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n"...)
-    }
-    for _, b := range params.Body {
-        if len(params.Body) > 1 {
-            body = append(body, "--" + boundary + "\r\nContent-Type: " + b.ContentType + "; charset=\"" + b.Charset + "\"\r\n" + b.Data + "\r\n"...)
-        } else {
-            body = append(body, "Content-Type: " + b.ContentType + "; charset=\"" + b.Charset + "\"\r\n" + b.Data + "\r\n"...)
-        }
+    // The headers are composed once, and the content is streamed into DATA.
+    msg, err := composeMessage(params)
+    if err != nil {
+        return nil, err
     }
-    if len(params.Body) > 1 {
-        body = append(body, "--" + boundary + "--\r\n"...)
+
+    if params.EnforceFromMatch {
+        if err = checkFromMatch(params); err != nil {
+            return nil, err
+        }
     }
 
     // Connect to the SMTP server
-    var c *smtp.Client
-    var err error
-    if params.TlsConfig != nil {
-        conn, err := tls.Dial("tcp", params.SmtpServerHost + ":" + strconv.Itoa(params.SmtpServerPort), params.TlsConfig)
-        if err != nil {
-            return errors.New("tls.Dial() error. err=" + err.Error())
-        }
-        c, err = smtp.NewClient(conn, params.SmtpServerHost)
-        if err != nil {
-            return errors.New("smtp.NewClient() error. err=" + err.Error())
-        }
-    } else {
-        c, err = smtp.Dial(params.SmtpServerHost + ":" + strconv.Itoa(params.SmtpServerPort))
-        if err != nil {
-            return errors.New("smtp.Dial() error. err=" + err.Error())
-        }
+    phaseStart := time.Now()
+    c, err := dial(params)
+    if err != nil {
+        return nil, err
+    }
+    if params.Metrics != nil {
+        params.Metrics.ConnectDuration(time.Since(phaseStart))
     }
-    defer c.Close()
 
     // Authentication
     if params.AuthConfig != nil {
-        if params.AuthConfig.Crammd5Auth != nil {
-            auth := smtp.CRAMMD5Auth(params.AuthConfig.Crammd5Auth.UserName, params.AuthConfig.Crammd5Auth.Secret)
-            if err = c.Auth(auth); err != nil {
-                return errors.New("(*Client) Auth() error. err=" + err.Error())
-            }
+        phaseStart = time.Now()
+        if err = authenticate(c, params.AuthConfig, params.AllowInsecureAuth); err != nil {
+            c.Close()
+            return nil, err
         }
-        if params.AuthConfig.PlainAuth != nil {
-            auth := smtp.PlainAuth("", params.AuthConfig.PlainAuth.UserName, params.AuthConfig.PlainAuth.Password, params.AuthConfig.PlainAuth.Host)
-            if err = c.Auth(auth); err != nil {
-                return errors.New("(*Client) Auth() error. err=" + err.Error())
-            }
+        if params.Metrics != nil {
+            params.Metrics.AuthDuration(time.Since(phaseStart))
         }
     }
 
     // Mail commands
-    if err = c.Mail(params.Header.From); err != nil {
-        return errors.New("(*Client) Mail() error. err=" + err.Error())
+    phaseStart = time.Now()
+    if _, err = transact(c, params, msg); err != nil {
+        c.Close()
+        return nil, err
     }
-    if err = c.Rcpt(params.Header.To); err != nil {
-        return errors.New("(*Client) Rcpt() error. err=" + err.Error())
+    if params.Metrics != nil {
+        params.Metrics.DataDuration(time.Since(phaseStart))
+        params.Metrics.SendDuration(time.Since(start))
     }
-    wc, err := c.Data()
-    if err != nil {
-        return errors.New("(*Client) Data() error. err=" + err.Error())
+    return c, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Issue the mail commands of a transaction from MAIL to DATA.
+// It also returns whether the message data has started to be sent. If
+// so, the connection can not be reset, since the server still reads the
+// message data on the error.
+// The message size is counted beforehand only if the server advertises
+// SIZE. Otherwise the message is written in one pass.
+//////////////////////////////////////////////////////////////////////
+func transact(c *smtp.Client, params *Params, msg *composedMessage) (bool, error) {
+    mailParams := params.MailParams
+    rcptOpts := ""
+    if params.Dsn != nil {
+        if err := params.Dsn.validate(); err != nil {
+            return false, err
+        }
+        if ok, _ := c.Extension("DSN"); !ok {
+            return false, errors.New("server does not support DSN")
+        }
+        mailParams = make(map[string]string)
+        for k, v := range params.MailParams {
+            mailParams[k] = v
+        }
+        for k, v := range params.Dsn.mailParams() {
+            mailParams[k] = v
+        }
+        if len(params.Dsn.Notify) > 0 {
+            rcptOpts = " NOTIFY=" + strings.Join(params.Dsn.Notify, ",")
+        }
     }
-    _, err = wc.Write(body)
-    if err != nil {
-        return errors.New("(io.WriteCloser) Write() error. err=" + err.Error())
+    binary := usesBinary(params)
+    if binary {
+        // Binary data can be sent only with BDAT.
+        ok, _ := c.Extension("BINARYMIME")
+        chunking, _ := c.Extension("CHUNKING")
+        if !ok || !chunking {
+            return false, errors.New("server does not support BINARYMIME, which the message requires")
+        }
     }
-    if err = wc.Close(); err != nil {
-        return errors.New("(*Client) Quit() error. err=" + err.Error())
+    size := 0
+    if ok, _ := c.Extension("SIZE"); ok {
+        var err error
+        if size, err = msg.size(); err != nil {
+            return false, err
+        }
     }
-    if err = c.Quit(); err != nil {
-        return errors.New("(*Client) Quit() error. err=" + err.Error())
+    if err := mailFrom(c, addrSpec(envelopeFrom(params)), size, mailParams, binary, needsSmtpUtf8(params, msg.header)); err != nil {
+        return false, err
     }
-    return nil
+    rejected := make([]*RejectedRecipient, 0)
+    for _, rcpt := range dedupeRecipients(recipients(params.Header)) {
+        if err := rcptTo(c, addrSpec(rcpt), rcptOpts); err != nil {
+            var smtpErr *SMTPError
+            if params.strictRcpt && errors.As(err, &smtpErr) {
+                rejected = append(rejected, &RejectedRecipient{Address: addrSpec(rcpt), Code: smtpErr.Code, Message: smtpErr.Message})
+                continue
+            }
+            return false, err
+        }
+    }
+    if len(rejected) > 0 {
+        return false, &RecipientsError{Rejected: rejected}
+    }
+    var wc io.WriteCloser
+    if ok, _ := c.Extension("CHUNKING"); binary {
+        wc = &bdatWriter{text: c.Text}
+    } else if ok {
+        wc = &dataOrBdatWriter{c: c}
+    } else {
+        var err error
+        if wc, err = c.Data(); err != nil {
+            return false, smtpError("(*Client) Data()", err)
+        }
+    }
+    if err := msg.writeTo(wc); err != nil {
+        return true, err
+    }
+    if err := wc.Close(); err != nil {
+        return true, smtpError("(*Client) Data() close", err)
+    }
+    return true, nil
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate Params
-// @param smtpServerHost string: SMTP server Host.
-// @param smtpServerPort string: SMTP server Port.
-// @param header *Header: Mail Header.
-// @param body string: Mail message.
-// @param authConfig *AuthConfig: Authentication configuration.
-// @param tlsConfig *tls.Config: TLS configuration.
+// Check if the envelope addresses or the composed header block have
+// non-ASCII, which requires SMTPUTF8 (RFC6531).
 //////////////////////////////////////////////////////////////////////
-func GenParams(smtpServerHost string, smtpServerPort int, header *Header, body []*Body, authConfig *AuthConfig, tlsConfig *tls.Config) *Params {
-    return &Params{
-        AuthConfig: authConfig,
-        Body: body,
-        Header: header,
-        SmtpServerHost: smtpServerHost,
-        SmtpServerPort: smtpServerPort,
-        TlsConfig: tlsConfig,
+func needsSmtpUtf8(params *Params, header string) bool {
+    values := append([]string{envelopeFrom(params), header}, recipients(params.Header)...)
+    for _, v := range values {
+        if _, err := encodeUsAscii(v); err != nil {
+            return true
+        }
     }
+    return false
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate CRAMMD5Auth Struct
+// Check if the message has binary attachments, which require BINARYMIME.
 //////////////////////////////////////////////////////////////////////
-func GenCRAMMD5Auth(userName string, secret string) *AuthConfig {
-    a := &CRAMMD5Auth{
-        UserName: userName,
-        Secret: secret,
+func usesBinary(params *Params) bool {
+    if params.PgpConfig != nil {
+        return false
     }
-    return &AuthConfig{
-        Crammd5Auth: a,
+    for _, a := range params.Attachments {
+        if a.transferEncoding() == TRANSFER_ENCODING_BINARY {
+            return true
+        }
     }
+    return false
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate PlainAuth Struct
+// Send RCPT TO with the options (e.g. " NOTIFY=FAILURE").
 //////////////////////////////////////////////////////////////////////
-func GenPlainAuth(userName string, password string, host string) *AuthConfig {
-    a := &PlainAuth{
-        UserName: userName,
-        Password: password,
-        Host: host,
+func rcptTo(c *smtp.Client, rcpt string, rcptOpts string) error {
+    if rcptOpts == "" {
+        if err := c.Rcpt(rcpt); err != nil {
+            return smtpError("(*Client) Rcpt()", err)
+        }
+        return nil
     }
-    return &AuthConfig{
-        PlainAuth: a,
+    if strings.ContainsAny(rcpt, "\r\n") {
+        return errors.New("invalid recipient. rcpt=" + strconv.Quote(rcpt))
     }
+    if _, err := textCmd(c.Text, 25, "RCPT TO:<%s>%s", rcpt, rcptOpts); err != nil {
+        return smtpError("(*Client) Rcpt()", err)
+    }
+    return nil
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate TLS Configuration Struct
+// Check that the From address matches the PLAIN auth user name, which
+// many servers require.
 //////////////////////////////////////////////////////////////////////
-func GenTlsConfig(serverName string) *tls.Config {
-    return &tls.Config{
-        ServerName: serverName,
+func checkFromMatch(params *Params) error {
+    if params.AuthConfig == nil || params.AuthConfig.PlainAuth == nil {
+        return nil
     }
+    from, err := mail.ParseAddress(params.Header.From)
+    if err != nil {
+        return errors.New("mail.ParseAddress() error. address=" + params.Header.From + " err=" + err.Error())
+    }
+    if !strings.EqualFold(from.Address, params.AuthConfig.PlainAuth.UserName) {
+        return errors.New("From does not match the auth user name. from=" + from.Address + " userName=" + params.AuthConfig.PlainAuth.UserName)
+    }
+    return nil
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Set certificate files into the TLS config.
+// Connect to the SMTP server.
+// If the connection is given, it is used instead of dialing.
+// The TLS config is used for implicit TLS, or for STARTTLS if enabled.
 //////////////////////////////////////////////////////////////////////
-func SetCertFiles(tlsConfig *tls.Config, certFile string, keyFile string) (*tls.Config, error) {
-    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+func dial(params *Params) (*smtp.Client, error) {
+    var conn net.Conn
+    var err error
+    network, addr, host := serverAddr(params)
+    implicitTls := params.TlsConfig != nil && !params.StartTls
+    var tlsConfig *tls.Config
+    if params.TlsConfig != nil || params.StartTls {
+        // The certificate is verified against ServerName, not the dialed host.
+        // The client still has the dialed host, which the auth is checked
+        // against.
+        tlsConfig = serverTlsConfig(params, host)
+    }
+    dialer := &net.Dialer{Timeout: params.Timeout}
+    if params.Conn != nil {
+        conn = params.Conn
+        if implicitTls {
+            conn = tls.Client(conn, tlsConfig)
+        }
+    } else if implicitTls {
+        conn, err = tls.DialWithDialer(dialer, network, addr, tlsConfig)
+        if err != nil {
+            return nil, fmt.Errorf("tls.Dial() error. err=%w", err)
+        }
+    } else {
+        conn, err = dialer.Dial(network, addr)
+        if err != nil {
+            return nil, fmt.Errorf("net.Dial() error. err=%w", err)
+        }
+    }
+
+    // A server which accepts the connection but never greets would block forever.
+    if params.Timeout > 0 {
+        conn.SetDeadline(time.Now().Add(params.Timeout))
+    }
+    c, err := smtp.NewClient(conn, host)
     if err != nil {
-        return tlsConfig, err
+        conn.Close()
+        return nil, fmt.Errorf("smtp.NewClient() error. err=%w", err)
     }
-    tlsConfig.Certificates = []tls.Certificate{cert}
-    return tlsConfig, nil
+
+    // STARTTLS
+    if params.StartTls {
+        if ok, _ := c.Extension("STARTTLS"); !ok {
+            c.Close()
+            return nil, errors.New("server does not support STARTTLS")
+        }
+        if err = c.StartTLS(tlsConfig); err != nil {
+            c.Close()
+            return nil, smtpError("(*Client) StartTLS()", err)
+        }
+    }
+    if params.Timeout > 0 {
+        conn.SetDeadline(time.Time{})
+    }
+    return c, nil
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Set certificate bytes into the TLS config.
+// Get the TLS config for the handshake.
+// If ServerName of TlsConfig is empty, the server host name is used.
+// So it can be set independently, e.g. to dial "192.0.2.1" while verifying
+// the certificate for "mail.example.com".
 //////////////////////////////////////////////////////////////////////
-func SetCertBytes(tlsConfig *tls.Config, certPem []byte, keyPem []byte) (*tls.Config, error) {
-    cert, err := tls.X509KeyPair(certPem, keyPem)
-    if err != nil {
-        return tlsConfig, err
+func serverTlsConfig(params *Params, host string) *tls.Config {
+    if params.TlsConfig == nil {
+        return GenTlsConfig(host)
     }
-    tlsConfig.Certificates = []tls.Certificate{cert}
-    return tlsConfig, nil
+    if params.TlsConfig.ServerName != "" {
+        return params.TlsConfig
+    }
+    tlsConfig := params.TlsConfig.Clone()
+    tlsConfig.ServerName = host
+    return tlsConfig
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate Header Struct
+// Get the network, the address to dial and the server host name.
+// The network is Network (e.g. "tcp4", "tcp6"), or "tcp" by default.
+// If SmtpServerHost has "unix:" prefix (e.g. "unix:/var/run/smtp.sock"),
+// the Unix domain socket is used, and the host name is "localhost".
 //////////////////////////////////////////////////////////////////////
-func GenHeader(from string, to string, subject string, mimeVersion string) *Header {
-    return &Header{
-        From: from,
-        MimeVersion: mimeVersion,
-        Subject: subject,
-        To: to,
+func serverAddr(params *Params) (string, string, string) {
+    if strings.HasPrefix(params.SmtpServerHost, "unix:") {
+        return "unix", strings.TrimPrefix(params.SmtpServerHost, "unix:"), "localhost"
+    }
+    network := params.Network
+    if network == "" {
+        network = "tcp"
     }
+    return network, params.SmtpServerHost + ":" + strconv.Itoa(params.SmtpServerPort), params.SmtpServerHost
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate a mail body from files.
+// Authenticate with the configured mechanisms.
+// Each mechanism must be advertised by the server in the AUTH extension.
+// If AuthFallback is set, the mechanisms are tried in order instead.
+// Plaintext credentials are refused over an unencrypted connection,
+// unless allowInsecure is true.
 //////////////////////////////////////////////////////////////////////
-func GenBodyFromFiles(contentType string, charset string, fileNames []string, params map[string]string) (*Body, error) {
-    f := template.FuncMap{
-        "safeHTML": func(s string) template.HTML { return template.HTML(s) },
+func authenticate(c *smtp.Client, authConfig *AuthConfig, allowInsecure bool) error {
+    ok, mechs := c.Extension("AUTH")
+    if !ok {
+        return errors.New("server does not support AUTH")
     }
-    t, err := template.New(path.Base(fileNames[0])).Funcs(f).ParseFiles(fileNames...)
-    if err != nil {
-        return nil, err
+    if authConfig.Auth != nil {
+        // The custom auth is responsible for refusing insecure connections.
+        if err := c.Auth(authConfig.Auth); err != nil {
+            return smtpError("(*Client) Auth()", err)
+        }
+        return nil
     }
-    buffer := new(bytes.Buffer)
-    if err := t.Execute(buffer, params); err != nil {
-        return nil, err
+    _, isTls := c.TLSConnectionState()
+    if len(authConfig.AuthFallback) > 0 {
+        var lastErr error
+        for _, method := range authConfig.AuthFallback {
+            auth := genSmtpAuth(authConfig, method, allowInsecure)
+            if auth == nil || !hasAuthMechanism(mechs, method) {
+                continue
+            }
+            if isPlaintextAuth(method) && !isTls && !allowInsecure {
+                lastErr = errors.New("refusing to send plaintext credentials over unencrypted connection")
+                continue
+            }
+            if err := c.Auth(auth); err != nil {
+                lastErr = smtpError("(*Client) Auth() method=" + string(method), err)
+                continue
+            }
+            return nil
+        }
+        if lastErr != nil {
+            return lastErr
+        }
+        return errors.New("server does not support any configured auth. mechanisms=" + mechs)
     }
-    body := &Body{
-        ContentType: contentType,
-        Charset: charset,
-        Data: buffer.String(),
+    for _, method := range []AuthMethod{AUTH_METHOD_SCRAM_SHA_256, AUTH_METHOD_CRAM_MD5, AUTH_METHOD_PLAIN} {
+        auth := genSmtpAuth(authConfig, method, allowInsecure)
+        if auth == nil {
+            continue
+        }
+        if !hasAuthMechanism(mechs, method) {
+            return errors.New("server does not support " + string(method) + " auth")
+        }
+        if isPlaintextAuth(method) && !isTls && !allowInsecure {
+            return errors.New("refusing to send plaintext credentials over unencrypted connection")
+        }
+        if err := c.Auth(auth); err != nil {
+            return smtpError("(*Client) Auth()", err)
+        }
     }
-    return body, nil
+    return nil
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate a mail body from strings.
+// Generate smtp.Auth of the method from the configuration.
+// Returns nil if the method is not configured.
 //////////////////////////////////////////////////////////////////////
-func GenBodyFromString(contentType string, charset string, text string, params map[string]string) (*Body, error) {
-    f := template.FuncMap{
-        "safeHTML": func(s string) template.HTML { return template.HTML(s) },
-    }
-    t, err := template.New("t").Funcs(f).Parse(text)
-    if err != nil {
-        return nil, err
-    }
-    buffer := new(bytes.Buffer)
-    if err := t.Execute(buffer, params); err != nil {
-        return nil, err
-    }
-    body := &Body{
-        ContentType: contentType,
-        Charset: charset,
-        Data: buffer.String(),
+func genSmtpAuth(authConfig *AuthConfig, method AuthMethod, allowInsecure bool) smtp.Auth {
+    switch method {
+    case AUTH_METHOD_SCRAM_SHA_256:
+        if authConfig.ScramSha256Auth != nil {
+            // Copied to keep the state of the exchange per connection.
+            a := *authConfig.ScramSha256Auth
+            return &a
+        }
+    case AUTH_METHOD_CRAM_MD5:
+        if authConfig.Crammd5Auth != nil {
+            return smtp.CRAMMD5Auth(authConfig.Crammd5Auth.UserName, authConfig.Crammd5Auth.Secret)
+        }
+    case AUTH_METHOD_PLAIN:
+        if authConfig.PlainAuth != nil {
+            if allowInsecure {
+                // smtp.PlainAuth refuses unencrypted connections except localhost.
+                return &insecurePlainAuth{
+                    userName: authConfig.PlainAuth.UserName,
+                    password: authConfig.PlainAuth.Password,
+                    host: authConfig.PlainAuth.Host,
+                }
+            }
+            return smtp.PlainAuth("", authConfig.PlainAuth.UserName, authConfig.PlainAuth.Password, authConfig.PlainAuth.Host)
+        }
     }
-    return body, nil
+    return nil
 }
 
 
 //////////////////////////////////////////////////////////////////////
-// Generate a radom value for boundary.
+// Check if the method sends the credentials as they are.
+//////////////////////////////////////////////////////////////////////
+func isPlaintextAuth(method AuthMethod) bool {
+    return method == AUTH_METHOD_PLAIN
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the mechanism is in the advertised AUTH mechanisms.
+//////////////////////////////////////////////////////////////////////
+func hasAuthMechanism(mechs string, method AuthMethod) bool {
+    for _, m := range strings.Fields(mechs) {
+        if strings.EqualFold(m, string(method)) {
+            return true
+        }
+    }
+    return false
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Issue the MAIL command.
+// If the server advertises SIZE, the message size is checked against the
+// limit before sending it, and passed as SIZE parameter.
+// For binary data, BODY=BINARYMIME is passed instead of BODY=8BITMIME.
+// SMTPUTF8 is passed only if the message needs it and the server supports it.
+//////////////////////////////////////////////////////////////////////
+func mailFrom(c *smtp.Client, from string, size int, mailParams map[string]string, binary bool, smtpUtf8 bool) error {
+    if strings.ContainsAny(from, "\r\n") {
+        return errors.New("invalid from. from=" + strconv.Quote(from))
+    }
+    opts := ""
+    if binary {
+        opts += " BODY=BINARYMIME"
+    } else if ok, _ := c.Extension("8BITMIME"); ok {
+        opts += " BODY=8BITMIME"
+    }
+    if ok, _ := c.Extension("SMTPUTF8"); ok && smtpUtf8 {
+        opts += " SMTPUTF8"
+    }
+    if ok, limit := c.Extension("SIZE"); ok {
+        if n, err := strconv.Atoi(limit); err == nil && n > 0 && size > n {
+            return errors.New("message size exceeds the server limit. size=" + strconv.Itoa(size) + " limit=" + limit)
+        }
+        opts += " SIZE=" + strconv.Itoa(size)
+    }
+    keys := make([]string, 0, len(mailParams))
+    for k := range mailParams {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        key := strings.ToUpper(k)
+        value := mailParams[k]
+        if !isEsmtpKeyword(key) || !isEsmtpValue(value) {
+            return errors.New("invalid mail parameter. key=" + strconv.Quote(k) + " value=" + strconv.Quote(value))
+        }
+        switch key {
+        case "BODY", "SMTPUTF8", "SIZE":
+            log.Println("mailer: mail parameter is set automatically, and skipped. key=" + key)
+            continue
+        }
+        ext, ok := mailParamExtensions[key]
+        if !ok {
+            ext = key
+        }
+        if ok, _ := c.Extension(ext); !ok {
+            log.Println("mailer: server does not support the extension, and mail parameter is skipped. key=" + key + " extension=" + ext)
+            continue
+        }
+        opts += " " + key
+        if value != "" {
+            opts += "=" + value
+        }
+    }
+    if _, err := textCmd(c.Text, 250, "MAIL FROM:<%s>%s", from, opts); err != nil {
+        return smtpError("(*Client) Mail()", err)
+    }
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send a command and read the response with the expected code.
+//////////////////////////////////////////////////////////////////////
+func textCmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) (string, error) {
+    id, err := text.Cmd(format, args...)
+    if err != nil {
+        return "", err
+    }
+    text.StartResponse(id)
+    defer text.EndResponse(id)
+    _, msg, err := text.ReadResponse(expectCode)
+    return msg, err
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Wrap the error of the command.
+// If the error is a reply from the server, it is returned as SMTPError.
+//////////////////////////////////////////////////////////////////////
+func smtpError(command string, err error) error {
+    if tpErr, ok := err.(*textproto.Error); ok {
+        return &SMTPError{
+            Code: tpErr.Code,
+            Command: command,
+            Message: tpErr.Msg,
+        }
+    }
+    // The cause is kept, e.g. for retrying on network errors.
+    return fmt.Errorf("%s error. err=%w", command, err)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the error message.
+//////////////////////////////////////////////////////////////////////
+func (e *SMTPError) Error() string {
+    return e.Command + " error. err=" + strconv.Itoa(e.Code) + " " + e.Message
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the error message listing the rejected recipients.
+//////////////////////////////////////////////////////////////////////
+func (e *RecipientsError) Error() string {
+    rejected := make([]string, 0, len(e.Rejected))
+    for _, r := range e.Rejected {
+        rejected = append(rejected, r.Address + "=" + strconv.Itoa(r.Code) + " " + r.Message)
+    }
+    return "recipients rejected. " + strings.Join(rejected, ", ")
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the error is transient (4xx), which may succeed on retry.
+//////////////////////////////////////////////////////////////////////
+func (e *SMTPError) Temporary() bool {
+    return e.Code >= 400 && e.Code < 500
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the string is an esmtp-keyword (RFC5321).
+//////////////////////////////////////////////////////////////////////
+func isEsmtpKeyword(s string) bool {
+    if s == "" {
+        return false
+    }
+    for i, r := range s {
+        if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' && i > 0) {
+            return false
+        }
+    }
+    return true
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the string is an esmtp-value (RFC5321), which may be empty.
+//////////////////////////////////////////////////////////////////////
+func isEsmtpValue(s string) bool {
+    for _, r := range s {
+        if r < 33 || r > 126 || r == '=' {
+            return false
+        }
+    }
+    return true
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Normalize the raw header block into CRLF-terminated lines and
+// validate it.
+//////////////////////////////////////////////////////////////////////
+func normalizeRawHeader(rawHeader string) (string, error) {
+    raw := strings.TrimRight(string(normalizeCRLF([]byte(rawHeader))), "\r\n")
+    if raw == "" {
+        return "", errors.New("raw header is empty")
+    }
+    for i, line := range strings.Split(raw, "\r\n") {
+        if line == "" {
+            return "", errors.New("raw header has a blank line. line=" + strconv.Itoa(i + 1))
+        }
+        if line[0] == ' ' || line[0] == '\t' {
+            if i == 0 {
+                return "", errors.New("raw header starts with a continuation line")
+            }
+            continue
+        }
+        colon := strings.Index(line, ":")
+        if colon <= 0 || strings.IndexFunc(line[:colon], func(r rune) bool { return r < 33 || r > 126 }) >= 0 {
+            return "", errors.New("invalid raw header line. line=" + strconv.Quote(line))
+        }
+        switch textproto.CanonicalMIMEHeaderKey(line[:colon]) {
+        case "Content-Type", "Content-Transfer-Encoding":
+            return "", errors.New("raw header must not have content headers. line=" + strconv.Quote(line))
+        }
+    }
+    return raw + "\r\n", nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the address for MAIL FROM.
+// It is EnvelopeFrom if set, or Sender if From has multiple addresses,
+// or else From.
+//////////////////////////////////////////////////////////////////////
+func envelopeFrom(params *Params) string {
+    if params.EnvelopeFrom != "" {
+        return params.EnvelopeFrom
+    }
+    if params.Header.Sender != "" && isMultiFrom(params.Header.From) {
+        return params.Header.Sender
+    }
+    return params.Header.From
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if From has multiple addresses.
+//////////////////////////////////////////////////////////////////////
+func isMultiFrom(from string) bool {
+    list, err := mail.ParseAddressList(from)
+    return err == nil && len(list) > 1
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the addr-spec (e.g. "noreply@example.com") of the address.
+// If the address can not be parsed, it is returned as it is.
+//////////////////////////////////////////////////////////////////////
+func addrSpec(addr string) string {
+    a, err := mail.ParseAddress(addr)
+    if err != nil {
+        return addr
+    }
+    return a.Address
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Split a comma or semicolon separated address list into the addr-specs.
+// e.g.) "Foo <foo@example.com>; bar@example.com"
+//       -> []string{"foo@example.com", "bar@example.com"}
+// Separators in quoted strings, comments and angle brackets are ignored.
+// If an entry is invalid, the error tells which one.
+//////////////////////////////////////////////////////////////////////
+func ParseAddressList(s string) ([]string, error) {
+    entries := make([]string, 0)
+    start := 0
+    quoted := false
+    escaped := false
+    depth := 0
+    for i := 0; i < len(s); i++ {
+        if escaped {
+            escaped = false
+            continue
+        }
+        switch s[i] {
+        case '\\':
+            escaped = quoted || depth > 0
+        case '"':
+            if depth == 0 {
+                quoted = !quoted
+            }
+        case '(', '<':
+            if !quoted {
+                depth++
+            }
+        case ')', '>':
+            if !quoted && depth > 0 {
+                depth--
+            }
+        case ',', ';':
+            if !quoted && depth == 0 {
+                entries = append(entries, s[start:i])
+                start = i + 1
+            }
+        }
+    }
+    entries = append(entries, s[start:])
+    addrs := make([]string, 0, len(entries))
+    for i, entry := range entries {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        a, err := mail.ParseAddress(entry)
+        if err != nil {
+            return nil, errors.New("mail.ParseAddress() error. index=" + strconv.Itoa(i) + ", address=" + strconv.Quote(entry) + ", err=" + err.Error())
+        }
+        addrs = append(addrs, a.Address)
+    }
+    return addrs, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get all recipients of To, Cc and Bcc.
+//////////////////////////////////////////////////////////////////////
+func recipients(header *Header) []string {
+    rcpts := make([]string, 0)
+    if header.To != "" {
+        rcpts = append(rcpts, header.To)
+    }
+    for _, g := range header.ToGroups {
+        rcpts = append(rcpts, g.Addresses...)
+    }
+    rcpts = append(rcpts, header.Cc...)
+    for _, g := range header.CcGroups {
+        rcpts = append(rcpts, g.Addresses...)
+    }
+    rcpts = append(rcpts, header.Bcc...)
+    return rcpts
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Remove duplicated recipients, keeping the first occurrence.
+// The addr-specs are compared with the domain part case-insensitively.
+//////////////////////////////////////////////////////////////////////
+func dedupeRecipients(rcpts []string) []string {
+    seen := make(map[string]bool)
+    deduped := make([]string, 0, len(rcpts))
+    for _, rcpt := range rcpts {
+        key := addrSpec(rcpt)
+        if i := strings.LastIndex(key, "@"); i >= 0 {
+            key = key[:i] + strings.ToLower(key[i:])
+        }
+        if seen[key] {
+            continue
+        }
+        seen[key] = true
+        deduped = append(deduped, rcpt)
+    }
+    return deduped
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Params
+// @param smtpServerHost string: SMTP server Host.
+// @param smtpServerPort string: SMTP server Port.
+// @param header *Header: Mail Header.
+// @param body string: Mail message.
+// @param authConfig *AuthConfig: Authentication configuration.
+// @param tlsConfig *tls.Config: TLS configuration.
+//////////////////////////////////////////////////////////////////////
+func GenParams(smtpServerHost string, smtpServerPort int, header *Header, body []*Body, authConfig *AuthConfig, tlsConfig *tls.Config) *Params {
+    return &Params{
+        AuthConfig: authConfig,
+        Body: body,
+        Header: header,
+        SmtpServerHost: smtpServerHost,
+        SmtpServerPort: smtpServerPort,
+        TlsConfig: tlsConfig,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Copy the params, so that the copy can be modified without affecting
+// the original, e.g. for variations of a message or concurrent sends.
+// Header, Body, Footer, Attachments, InlineImages, MailParams, Dsn,
+// AuthConfig and TlsConfig are copied. The data of the attachments and
+// the inline images, Conn, Metrics, PgpConfig and the custom Auth are shared.
+//////////////////////////////////////////////////////////////////////
+func (p *Params) Clone() *Params {
+    c := *p
+    if p.Header != nil {
+        header := *p.Header
+        header.Bcc = cloneStrings(header.Bcc)
+        header.Cc = cloneStrings(header.Cc)
+        header.CcGroups = cloneGroups(header.CcGroups)
+        if header.ExtraHeaders != nil {
+            header.ExtraHeaders = make([]*HeaderField, len(p.Header.ExtraHeaders))
+            for i, f := range p.Header.ExtraHeaders {
+                nf := *f
+                header.ExtraHeaders[i] = &nf
+            }
+        }
+        header.Keywords = cloneStrings(header.Keywords)
+        header.References = cloneStrings(header.References)
+        header.ToGroups = cloneGroups(header.ToGroups)
+        c.Header = &header
+    }
+    if p.Body != nil {
+        c.Body = make([]*Body, len(p.Body))
+        clonedOf := make(map[*Body]*Body)
+        for i, b := range p.Body {
+            nb := *b
+            c.Body[i] = &nb
+            clonedOf[b] = &nb
+        }
+        for _, b := range c.Body {
+            if src, ok := clonedOf[b.textOf]; ok {
+                b.textOf = src
+            }
+        }
+    }
+    if p.Footer != nil {
+        footer := *p.Footer
+        c.Footer = &footer
+    }
+    if p.Attachments != nil {
+        c.Attachments = make([]*Attachment, len(p.Attachments))
+        for i, a := range p.Attachments {
+            na := *a
+            c.Attachments[i] = &na
+        }
+    }
+    if p.InlineImages != nil {
+        c.InlineImages = make([]*InlineImage, len(p.InlineImages))
+        for i, img := range p.InlineImages {
+            nimg := *img
+            c.InlineImages[i] = &nimg
+        }
+    }
+    if p.MailParams != nil {
+        c.MailParams = make(map[string]string, len(p.MailParams))
+        for k, v := range p.MailParams {
+            c.MailParams[k] = v
+        }
+    }
+    if p.Dsn != nil {
+        dsn := *p.Dsn
+        dsn.Notify = cloneStrings(dsn.Notify)
+        c.Dsn = &dsn
+    }
+    if p.AuthConfig != nil {
+        authConfig := *p.AuthConfig
+        if authConfig.AuthFallback != nil {
+            authConfig.AuthFallback = append([]AuthMethod(nil), authConfig.AuthFallback...)
+        }
+        if authConfig.Crammd5Auth != nil {
+            crammd5Auth := *authConfig.Crammd5Auth
+            authConfig.Crammd5Auth = &crammd5Auth
+        }
+        if authConfig.PlainAuth != nil {
+            plainAuth := *authConfig.PlainAuth
+            authConfig.PlainAuth = &plainAuth
+        }
+        if authConfig.ScramSha256Auth != nil {
+            scramSha256Auth := *authConfig.ScramSha256Auth
+            authConfig.ScramSha256Auth = &scramSha256Auth
+        }
+        c.AuthConfig = &authConfig
+    }
+    if p.TlsConfig != nil {
+        c.TlsConfig = p.TlsConfig.Clone()
+    }
+    return &c
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Copy the strings. nil is kept nil.
+//////////////////////////////////////////////////////////////////////
+func cloneStrings(s []string) []string {
+    if s == nil {
+        return nil
+    }
+    return append([]string(nil), s...)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Copy the groups. nil is kept nil.
+//////////////////////////////////////////////////////////////////////
+func cloneGroups(groups []*Group) []*Group {
+    if groups == nil {
+        return nil
+    }
+    cloned := make([]*Group, len(groups))
+    for i, g := range groups {
+        cloned[i] = &Group{Addresses: cloneStrings(g.Addresses), Name: g.Name}
+    }
+    return cloned
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate AuthConfig Struct with a custom smtp.Auth.
+//////////////////////////////////////////////////////////////////////
+func GenCustomAuth(auth smtp.Auth) *AuthConfig {
+    return &AuthConfig{
+        Auth: auth,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate CRAMMD5Auth Struct
+//////////////////////////////////////////////////////////////////////
+func GenCRAMMD5Auth(userName string, secret string) *AuthConfig {
+    a := &CRAMMD5Auth{
+        UserName: userName,
+        Secret: secret,
+    }
+    return &AuthConfig{
+        Crammd5Auth: a,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate ScramSha256Auth Struct
+//////////////////////////////////////////////////////////////////////
+func GenScramSha256Auth(userName string, password string, host string) *AuthConfig {
+    a := &ScramSha256Auth{
+        UserName: userName,
+        Password: password,
+        Host: host,
+    }
+    return &AuthConfig{
+        ScramSha256Auth: a,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate PlainAuth Struct
+//////////////////////////////////////////////////////////////////////
+func GenPlainAuth(userName string, password string, host string) *AuthConfig {
+    a := &PlainAuth{
+        UserName: userName,
+        Password: password,
+        Host: host,
+    }
+    return &AuthConfig{
+        PlainAuth: a,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate PlainAuth Struct from the environment variables.
+//     - <prefix>_SMTP_USER
+//     - <prefix>_SMTP_PASSWORD
+//     - <prefix>_SMTP_HOST
+//////////////////////////////////////////////////////////////////////
+func GenPlainAuthFromEnv(prefix string) (*AuthConfig, error) {
+    values := make([]string, 0, 3)
+    for _, name := range []string{"_SMTP_USER", "_SMTP_PASSWORD", "_SMTP_HOST"} {
+        value, ok := os.LookupEnv(prefix + name)
+        if !ok || value == "" {
+            return nil, errors.New("environment variable is not set. name=" + prefix + name)
+        }
+        values = append(values, value)
+    }
+    return GenPlainAuth(values[0], values[1], values[2]), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate TLS Configuration Struct
+// The serverName is the name in the server certificate. SmtpServerHost
+// is still used to dial, so it can be an IP address or a load balancer.
+//////////////////////////////////////////////////////////////////////
+func GenTlsConfig(serverName string) *tls.Config {
+    return &tls.Config{
+        ServerName: serverName,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set certificate files into the TLS config.
+// The certificate is presented only if it matches the CAs accepted by
+// the server. For client certificate authentication, use SetClientCert().
+//////////////////////////////////////////////////////////////////////
+func SetCertFiles(tlsConfig *tls.Config, certFile string, keyFile string) (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return tlsConfig, err
+    }
+    tlsConfig.Certificates = []tls.Certificate{cert}
+    return tlsConfig, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set certificate bytes into the TLS config.
+//////////////////////////////////////////////////////////////////////
+func SetCertBytes(tlsConfig *tls.Config, certPem []byte, keyPem []byte) (*tls.Config, error) {
+    cert, err := tls.X509KeyPair(certPem, keyPem)
+    if err != nil {
+        return tlsConfig, err
+    }
+    tlsConfig.Certificates = []tls.Certificate{cert}
+    return tlsConfig, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set a client certificate into the TLS config for relays requiring
+// client certificate authentication (mutual TLS).
+// The certificate is presented whenever the server requests one.
+//////////////////////////////////////////////////////////////////////
+func SetClientCert(tlsConfig *tls.Config, certFile string, keyFile string) (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return tlsConfig, errors.New("tls.LoadX509KeyPair() error. err=" + err.Error())
+    }
+    tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+        return &cert, nil
+    }
+    return tlsConfig, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set certificate PEM strings into the TLS config, e.g. from environment
+// variables. Line breaks escaped as the two characters `\n` are unescaped.
+//////////////////////////////////////////////////////////////////////
+func SetCertPEMStrings(tlsConfig *tls.Config, certPEM string, keyPEM string) (*tls.Config, error) {
+    return SetCertBytes(tlsConfig, []byte(unescapePEM(certPEM)), []byte(unescapePEM(keyPEM)))
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add CA certificates into RootCAs of the TLS config, e.g. for a server
+// with a private CA. If RootCAs is nil, a new pool is created, so that
+// the system roots are not trusted.
+//////////////////////////////////////////////////////////////////////
+func SetRootCAs(tlsConfig *tls.Config, caPem []byte) (*tls.Config, error) {
+    pool := tlsConfig.RootCAs
+    if pool == nil {
+        pool = x509.NewCertPool()
+    }
+    if !pool.AppendCertsFromPEM(caPem) {
+        return tlsConfig, errors.New("no CA certificate is found in PEM")
+    }
+    tlsConfig.RootCAs = pool
+    return tlsConfig, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add CA certificates in the file into RootCAs of the TLS config.
+//////////////////////////////////////////////////////////////////////
+func SetRootCAsFromFile(tlsConfig *tls.Config, caFile string) (*tls.Config, error) {
+    caPem, err := os.ReadFile(caFile)
+    if err != nil {
+        return tlsConfig, errors.New("os.ReadFile() error. err=" + err.Error())
+    }
+    return SetRootCAs(tlsConfig, caPem)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Unescape the line breaks of a PEM string escaped in a single line.
+//////////////////////////////////////////////////////////////////////
+func unescapePEM(s string) string {
+    if strings.Contains(s, "\n") {
+        return s
+    }
+    s = strings.ReplaceAll(s, "\\r\\n", "\n")
+    return strings.ReplaceAll(s, "\\n", "\n")
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Attachment Struct
+//////////////////////////////////////////////////////////////////////
+func GenAttachment(fileName string, contentType string, data []byte) *Attachment {
+    return &Attachment{
+        ContentType: contentType,
+        Data: data,
+        FileName: fileName,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Attachment Struct from a file.
+// If the content type is empty, it is detected from the file extension.
+//////////////////////////////////////////////////////////////////////
+func GenAttachmentFromFile(filePath string, contentType string) (*Attachment, error) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil, err
+    }
+    if contentType == "" {
+        contentType = mime.TypeByExtension(path.Ext(filePath))
+        if contentType == "" {
+            contentType = CONTENT_TYPE_APPLICATION_OCTET_STREAM
+        }
+    }
+    return GenAttachment(path.Base(filePath), contentType, data), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Add an attachment streamed from the reader into DATA with base64.
+// The size is the number of bytes read, which is used for the message
+// size (e.g. SIZE and BDAT) without reading it. If the reader returns
+// fewer bytes, sending fails. The reader can be sent only once, and it
+// can not be used with Gzip or PgpConfig.
+//////////////////////////////////////////////////////////////////////
+func (p *Params) AttachReader(fileName string, contentType string, r io.Reader, size int64) *Attachment {
+    a := &Attachment{
+        ContentType: contentType,
+        FileName: fileName,
+        reader: r,
+        readerSize: size,
+    }
+    p.Attachments = append(p.Attachments, a)
+    return a
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Attachment Struct of an email (message/rfc822), e.g. to
+// forward it as an attachment.
+// The message is embedded as it is with 7bit or 8bit. With NUL or lines
+// longer than 998 octets, it is embedded with binary, which can be sent
+// only to servers supporting BINARYMIME (RFC3030).
+//////////////////////////////////////////////////////////////////////
+func GenMessageAttachment(rawEml []byte) *Attachment {
+    a := GenAttachment("forwarded.eml", CONTENT_TYPE_MESSAGE_RFC822, rawEml)
+    // base64 is not allowed for message/rfc822 (RFC2046 5.2.1).
+    a.TransferEncoding = DetectTransferEncoding(rawEml)
+    if a.TransferEncoding == TRANSFER_ENCODING_BASE64 {
+        a.TransferEncoding = TRANSFER_ENCODING_BINARY
+    }
+    return a
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Encode the attachment data and cache it.
+// When sending the same attachment many times, call it once beforehand
+// to avoid encoding it per message.
+//////////////////////////////////////////////////////////////////////
+func (a *Attachment) Encode() error {
+    if a.Data == nil {
+        return errors.New("attachment data is empty. fileName=" + a.FileName)
+    }
+    buffer := new(bytes.Buffer)
+    writeEncoded(buffer, a.transferEncoding(), a.data())
+    a.encoded = buffer.String()
+    a.encodedAs = a.encodingKey()
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the key of the encoded data, to check if the cache is up to date.
+//////////////////////////////////////////////////////////////////////
+func (a *Attachment) encodingKey() string {
+    if a.Gzip {
+        return "gzip+" + a.transferEncoding()
+    }
+    return a.transferEncoding()
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the data to be encoded, which is compressed with Gzip.
+//////////////////////////////////////////////////////////////////////
+func (a *Attachment) data() []byte {
+    if !a.Gzip {
+        return a.Data
+    }
+    buffer := new(bytes.Buffer)
+    zw := gzip.NewWriter(buffer)
+    zw.Name = a.FileName
+    zw.Write(a.Data)
+    zw.Close()
+    return buffer.Bytes()
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the content type sent, which is application/gzip with Gzip.
+//////////////////////////////////////////////////////////////////////
+func (a *Attachment) contentType() string {
+    if a.Gzip {
+        return CONTENT_TYPE_APPLICATION_GZIP
+    }
+    return a.ContentType
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the file name sent, which has ".gz" suffix with Gzip.
+//////////////////////////////////////////////////////////////////////
+func (a *Attachment) fileName() string {
+    if a.Gzip {
+        return a.FileName + ".gz"
+    }
+    return a.FileName
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the transfer encoding of the attachment.
+//////////////////////////////////////////////////////////////////////
+func (a *Attachment) transferEncoding() string {
+    if a.Gzip || a.reader != nil {
+        return TRANSFER_ENCODING_BASE64
+    }
+    if a.TransferEncoding != "" {
+        return a.TransferEncoding
+    }
+    if strings.HasPrefix(strings.ToLower(a.ContentType), "text/") {
+        return TRANSFER_ENCODING_QUOTED_PRINTABLE
+    }
+    return TRANSFER_ENCODING_BASE64
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate InlineImage Struct
+// The image is referred from HTML bodies as "cid:" + contentID.
+//////////////////////////////////////////////////////////////////////
+func GenInlineImage(contentID string, fileName string, contentType string, data []byte) *InlineImage {
+    return &InlineImage{
+        ContentID: contentID,
+        ContentType: contentType,
+        Data: data,
+        FileName: fileName,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Read an image file and add it into the inline images with a unique
+// Content-ID, which is returned to be referred as "cid:" + cid.
+// The content type is detected by the file extension.
+//////////////////////////////////////////////////////////////////////
+func AddInlineImageFromFile(params *Params, filePath string) (string, error) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return "", errors.New("os.ReadFile() error. err=" + err.Error())
+    }
+    contentType := mime.TypeByExtension(path.Ext(filePath))
+    if contentType == "" {
+        contentType = CONTENT_TYPE_APPLICATION_OCTET_STREAM
+    }
+    b := make([]byte, 16)
+    if _, err = crand.Read(b); err != nil {
+        return "", errors.New("rand.Read() error. err=" + err.Error())
+    }
+    cid := hex.EncodeToString(b) + "@go_mailer"
+    params.InlineImages = append(params.InlineImages, GenInlineImage(cid, path.Base(filePath), contentType, data))
+    return cid, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Header Struct
+//////////////////////////////////////////////////////////////////////
+func GenHeader(from string, to string, subject string, mimeVersion string) *Header {
+    return &Header{
+        From: from,
+        MimeVersion: mimeVersion,
+        Subject: subject,
+        To: to,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Header Struct with multiple From addresses.
+// The sender is required for it according to RFC5322.
+//////////////////////////////////////////////////////////////////////
+func GenHeaderMultiFrom(from []string, sender string, to string, subject string, mimeVersion string) *Header {
+    return &Header{
+        From: strings.Join(from, ", "),
+        MimeVersion: mimeVersion,
+        Sender: sender,
+        Subject: subject,
+        To: to,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set whether templates fail on missing keys in the body parameters
+// instead of rendering them as empty. Call it once at startup.
+//////////////////////////////////////////////////////////////////////
+func SetStrictTemplate(strict bool) {
+    strictTemplate = strict
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set whether X-Mailer is written as "go_mailer/" + VERSION when
+// Header.XMailer is empty. Call it once at startup.
+//////////////////////////////////////////////////////////////////////
+func SetDefaultXMailer(enabled bool) {
+    defaultXMailer = enabled
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set the header name of Header.IdempotencyKey, which is
+// "X-Idempotency-Key" by default. Call it once at startup.
+//////////////////////////////////////////////////////////////////////
+func SetIdempotencyKeyHeader(name string) {
+    idempotencyKeyHeader = textproto.CanonicalMIMEHeaderKey(name)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Group Struct
+//////////////////////////////////////////////////////////////////////
+func GenGroup(name string, addresses []string) *Group {
+    return &Group{
+        Addresses: addresses,
+        Name: name,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the group syntax (e.g. "Team: a@example.com, b@example.com;").
+//////////////////////////////////////////////////////////////////////
+func (g *Group) String() string {
+    return g.Name + ": " + strings.Join(g.Addresses, ", ") + ";"
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set the default charset used by GenBodyFrom*Default. Call it once at startup.
+//////////////////////////////////////////////////////////////////////
+func SetDefaultCharset(charset string) {
+    defaultCharset = charset
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Set the default content type used by GenBodyFrom*Default. Call it once at startup.
+//////////////////////////////////////////////////////////////////////
+func SetDefaultContentType(contentType string) {
+    defaultContentType = contentType
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from files.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromFiles(contentType string, charset string, fileNames []string, params map[string]string) (*Body, error) {
+    return genBodyFromFiles(contentType, charset, fileNames, params, &templateOptions{strict: strictTemplate})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate multipart/alternative bodies from HTML files and text files.
+// The bodies are ordered text first and HTML last, so that HTML is the
+// preferred one according to RFC1341.
+//////////////////////////////////////////////////////////////////////
+func GenAlternativeBody(htmlFiles []string, textFiles []string, charset string, params map[string]string) ([]*Body, error) {
+    textBody, err := GenBodyFromFiles(CONTENT_TYPE_TEXT_PLAIN, charset, textFiles, params)
+    if err != nil {
+        return nil, err
+    }
+    htmlBody, err := GenBodyFromFiles(CONTENT_TYPE_TEXT_HTML, charset, htmlFiles, params)
+    if err != nil {
+        return nil, err
+    }
+    return []*Body{textBody, htmlBody}, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate multipart/alternative bodies from HTML files only.
+// The text body is converted from the rendered HTML by HtmlToText.
+//////////////////////////////////////////////////////////////////////
+func GenAlternativeBodyFromHtml(htmlFiles []string, charset string, params map[string]string) ([]*Body, error) {
+    htmlBody, err := GenBodyFromFiles(CONTENT_TYPE_TEXT_HTML, charset, htmlFiles, params)
+    if err != nil {
+        return nil, err
+    }
+    textBody := &Body{
+        ContentType: CONTENT_TYPE_TEXT_PLAIN,
+        Charset: charset,
+        Data: HtmlToText(htmlBody.Data),
+        textOf: htmlBody,
+    }
+    return []*Body{textBody, htmlBody}, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate the subject and the bodies from the files in the directory:
+//     - subject.txt: Subject. Leading and trailing whitespace is trimmed.
+//     - body.txt: (Optional) Text body.
+//     - body.html: (Optional) HTML body. Without body.txt, the text body
+//       is converted from it by HtmlToText.
+// At least one of the bodies is required. The default charset is used.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromTemplateDir(fsys fs.FS, dir string, params map[string]string) (subject string, bodies []*Body, err error) {
+    opts := &templateOptions{strict: strictTemplate}
+    subjectText, ok, err := readTemplateFile(fsys, path.Join(dir, "subject.txt"))
+    if err != nil {
+        return "", nil, err
+    }
+    if !ok {
+        return "", nil, errors.New("subject.txt is not found. dir=" + dir)
+    }
+    // Subject is not HTML, so it must not be escaped.
+    t := texttemplate.New("subject.txt")
+    if opts.strict {
+        t = t.Option("missingkey=error")
+    }
+    if _, err = t.Parse(subjectText); err != nil {
+        return "", nil, errors.New("(*Template) Parse() error. name=subject.txt err=" + err.Error())
+    }
+    buffer := new(bytes.Buffer)
+    if err = t.Execute(buffer, params); err != nil {
+        return "", nil, errors.New("(*Template) Execute() error. name=subject.txt err=" + err.Error())
+    }
+    subject = strings.TrimSpace(buffer.String())
+
+    var textBody, htmlBody *Body
+    for _, file := range []struct{ name string; contentType string; body **Body }{
+        {"body.txt", CONTENT_TYPE_TEXT_PLAIN, &textBody},
+        {"body.html", CONTENT_TYPE_TEXT_HTML, &htmlBody},
+    } {
+        text, ok, err := readTemplateFile(fsys, path.Join(dir, file.name))
+        if err != nil {
+            return "", nil, err
+        }
+        if !ok {
+            continue
+        }
+        if *file.body, err = genBodyFromString(file.contentType, defaultCharset, text, params, opts); err != nil {
+            return "", nil, err
+        }
+    }
+    if textBody == nil && htmlBody == nil {
+        return "", nil, errors.New("body.txt and body.html are not found. dir=" + dir)
+    }
+    if textBody == nil {
+        textBody = &Body{
+            ContentType: CONTENT_TYPE_TEXT_PLAIN,
+            Charset: defaultCharset,
+            Data: HtmlToText(htmlBody.Data),
+            textOf: htmlBody,
+        }
+    }
+    bodies = []*Body{textBody}
+    if htmlBody != nil {
+        bodies = append(bodies, htmlBody)
+    }
+    return subject, bodies, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Read a template file from the file system.
+// A leading UTF-8 BOM is stripped. If the file does not exist, false is
+// returned without an error.
+//////////////////////////////////////////////////////////////////////
+func readTemplateFile(fsys fs.FS, name string) (string, bool, error) {
+    b, err := fs.ReadFile(fsys, name)
+    if errors.Is(err, fs.ErrNotExist) {
+        return "", false, nil
+    }
+    if err != nil {
+        return "", false, errors.New("fs.ReadFile() error. err=" + err.Error())
+    }
+    return string(bytes.TrimPrefix(b, utf8Bom)), true, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from files by executing the named layout template.
+// The files defining the layout are parsed first, so that the blocks in it
+// (e.g. {{block "content" .}}{{end}}) can be overridden by the other files.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromLayout(contentType string, charset string, layoutName string, fileNames []string, params map[string]string) (*Body, error) {
+    opts := &templateOptions{strict: strictTemplate}
+    layoutFiles := make([]string, 0)
+    otherFiles := make([]string, 0)
+    for _, fileName := range fileNames {
+        t, err := parseFiles(opts, []string{fileName})
+        if err != nil {
+            return nil, err
+        }
+        if t.Lookup(layoutName) != nil {
+            layoutFiles = append(layoutFiles, fileName)
+        } else {
+            otherFiles = append(otherFiles, fileName)
+        }
+    }
+    if len(layoutFiles) == 0 {
+        return nil, errors.New("layout template is not defined. layoutName=" + layoutName)
+    }
+    t, err := parseFiles(opts, append(layoutFiles, otherFiles...))
+    if err != nil {
+        return nil, err
+    }
+    data, err := executeTemplate(t, layoutName, params)
+    if err != nil {
+        return nil, err
+    }
+    body := &Body{
+        ContentType: contentType,
+        Charset: charset,
+        Data: data,
+        tmpl: t,
+        tmplName: layoutName,
+    }
+    return body, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from strings.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromString(contentType string, charset string, text string, params map[string]string) (*Body, error) {
+    return genBodyFromString(contentType, charset, text, params, &templateOptions{strict: strictTemplate})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from files with the default content type and charset.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromFilesDefault(fileNames []string, params map[string]string) (*Body, error) {
+    return GenBodyFromFiles(defaultContentType, defaultCharset, fileNames, params)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from strings with the default content type and charset.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromStringDefault(text string, params map[string]string) (*Body, error) {
+    return GenBodyFromString(defaultContentType, defaultCharset, text, params)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a calendar body (e.g. a meeting invite) from iCalendar data.
+// The method should match the METHOD property of the data.
+//////////////////////////////////////////////////////////////////////
+func GenCalendarBody(ics string, method string) *Body {
+    return &Body{
+        ContentType: CONTENT_TYPE_TEXT_CALENDAR,
+        Charset: CHARSET_UTF8,
+        Data: ics,
+        Method: method,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from named strings.
+// The named templates can refer each other (e.g. {{template "header" .}}),
+// and the one of the root name is executed.
+// The root is parsed first, and then the others in the order of the names,
+// so that a template defined twice is always resolved the same.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromStrings(contentType string, charset string, named map[string]string, rootName string, params map[string]string) (*Body, error) {
+    if _, ok := named[rootName]; !ok {
+        return nil, errors.New("root template is not defined. rootName=" + rootName)
+    }
+    t := newTemplate(rootName, &templateOptions{strict: strictTemplate})
+    if _, err := t.Parse(named[rootName]); err != nil {
+        return nil, errors.New("(*Template) Parse() error. name=" + rootName + " err=" + err.Error())
+    }
+    names := make([]string, 0, len(named))
+    for name := range named {
+        if name != rootName {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        if _, err := t.New(name).Parse(named[name]); err != nil {
+            return nil, errors.New("(*Template) Parse() error. name=" + name + " err=" + err.Error())
+        }
+    }
+    data, err := executeTemplate(t, rootName, params)
+    if err != nil {
+        return nil, err
+    }
+    body := &Body{
+        ContentType: contentType,
+        Charset: charset,
+        Data: data,
+        tmpl: t,
+        tmplName: rootName,
+    }
+    return body, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from files.
+// A missing key in the body parameters is an error regardless of SetStrictTemplate.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromFilesStrict(contentType string, charset string, fileNames []string, params map[string]string) (*Body, error) {
+    return genBodyFromFiles(contentType, charset, fileNames, params, &templateOptions{strict: true})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from strings.
+// A missing key in the body parameters is an error regardless of SetStrictTemplate.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromStringStrict(contentType string, charset string, text string, params map[string]string) (*Body, error) {
+    return genBodyFromString(contentType, charset, text, params, &templateOptions{strict: true})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from files with the action delimiters
+// (e.g. "[[" and "]]") instead of "{{" and "}}".
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromFilesDelims(left string, right string, contentType string, charset string, fileNames []string, params map[string]string) (*Body, error) {
+    return genBodyFromFiles(contentType, charset, fileNames, params, &templateOptions{leftDelim: left, rightDelim: right, strict: strictTemplate})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from strings with the action delimiters
+// (e.g. "[[" and "]]") instead of "{{" and "}}".
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromStringDelims(left string, right string, contentType string, charset string, text string, params map[string]string) (*Body, error) {
+    return genBodyFromString(contentType, charset, text, params, &templateOptions{leftDelim: left, rightDelim: right, strict: strictTemplate})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from files.
+// safeHTML is not available, so that all output is escaped. It is for
+// templates written by untrusted authors.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromFilesNoRawHTML(contentType string, charset string, fileNames []string, params map[string]string) (*Body, error) {
+    return genBodyFromFiles(contentType, charset, fileNames, params, &templateOptions{noRawHTML: true, strict: strictTemplate})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from strings.
+// safeHTML is not available, so that all output is escaped. It is for
+// templates written by untrusted authors.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromStringNoRawHTML(contentType string, charset string, text string, params map[string]string) (*Body, error) {
+    return genBodyFromString(contentType, charset, text, params, &templateOptions{noRawHTML: true, strict: strictTemplate})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Render the template files directly into the writer without holding
+// the whole output in memory, e.g. for large newsletters.
+// The content type and charset are validated as the ones of a body.
+//////////////////////////////////////////////////////////////////////
+func RenderBodyTo(w io.Writer, contentType string, charset string, fileNames []string, params map[string]string) error {
+    if err := validateBody(&Body{ContentType: contentType, Charset: charset}); err != nil {
+        return err
+    }
+    t, err := parseFiles(&templateOptions{strict: strictTemplate}, fileNames)
+    if err != nil {
+        return err
+    }
+    if err = t.ExecuteTemplate(w, t.Name(), params); err != nil {
+        return errors.New("(*Template) ExecuteTemplate() error. name=" + t.Name() + " err=" + err.Error())
+    }
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from files with the template options.
+//////////////////////////////////////////////////////////////////////
+func genBodyFromFiles(contentType string, charset string, fileNames []string, params map[string]string, opts *templateOptions) (*Body, error) {
+    t, err := parseFiles(opts, fileNames)
+    if err != nil {
+        return nil, err
+    }
+    data, err := executeTemplate(t, t.Name(), params)
+    if err != nil {
+        return nil, err
+    }
+    body := &Body{
+        ContentType: contentType,
+        Charset: charset,
+        Data: data,
+        tmpl: t,
+        tmplName: t.Name(),
+    }
+    return body, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from strings with the template options.
+//////////////////////////////////////////////////////////////////////
+func genBodyFromString(contentType string, charset string, text string, params map[string]string, opts *templateOptions) (*Body, error) {
+    t, err := newTemplate("t", opts).Parse(text)
+    if err != nil {
+        return nil, errors.New("(*Template) Parse() error. err=" + err.Error())
+    }
+    data, err := executeTemplate(t, t.Name(), params)
+    if err != nil {
+        return nil, err
+    }
+    body := &Body{
+        ContentType: contentType,
+        Charset: charset,
+        Data: data,
+        tmpl: t,
+        tmplName: t.Name(),
+    }
+    return body, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a template with the template options.
+//////////////////////////////////////////////////////////////////////
+func newTemplate(name string, opts *templateOptions) *template.Template {
+    t := template.New(name)
+    if !opts.noRawHTML {
+        t = t.Funcs(genFuncMap())
+    }
+    if opts.strict {
+        t = t.Option("missingkey=error")
+    }
+    if opts.leftDelim != "" || opts.rightDelim != "" {
+        t = t.Delims(opts.leftDelim, opts.rightDelim)
+    }
+    return t
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Parse files into a template named after the first file.
+// A leading UTF-8 BOM of each file is stripped, so that it does not leak
+// into the rendered body.
+//////////////////////////////////////////////////////////////////////
+func parseFiles(opts *templateOptions, fileNames []string) (*template.Template, error) {
+    if len(fileNames) == 0 {
+        return nil, errors.New("template files are empty")
+    }
+    t := newTemplate(path.Base(fileNames[0]), opts)
+    for _, fileName := range fileNames {
+        b, err := os.ReadFile(fileName)
+        if err != nil {
+            return nil, errors.New("os.ReadFile() error. err=" + err.Error())
+        }
+        name := path.Base(fileName)
+        tmpl := t
+        if name != t.Name() {
+            tmpl = t.New(name)
+        }
+        if _, err = tmpl.Parse(string(bytes.TrimPrefix(b, utf8Bom))); err != nil {
+            return nil, errors.New("(*Template) Parse() error. err=" + err.Error())
+        }
+    }
+    return t, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Execute the named template.
+// The error is wrapped with the template name.
+//////////////////////////////////////////////////////////////////////
+func executeTemplate(t *template.Template, name string, params map[string]string) (string, error) {
+    buffer := new(bytes.Buffer)
+    if err := t.ExecuteTemplate(buffer, name, params); err != nil {
+        return "", errors.New("(*Template) ExecuteTemplate() error. name=" + name + " err=" + err.Error())
+    }
+    return buffer.String(), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate the content type and the charset of a body, which are
+// written into the headers as they are.
+//////////////////////////////////////////////////////////////////////
+func validateBody(b *Body) error {
+    types := strings.Split(b.ContentType, "/")
+    if len(types) != 2 || !isToken(types[0]) || !isToken(types[1]) {
+        return errors.New("invalid content type. contentType=" + strconv.Quote(b.ContentType))
+    }
+    if !isToken(b.Charset) {
+        return errors.New("invalid charset. charset=" + strconv.Quote(b.Charset))
+    }
+    if _, err := encodeCharset(b.Charset, b.Data); err != nil {
+        return err
+    }
+    switch b.TransferEncoding {
+    case "", TRANSFER_ENCODING_7BIT, TRANSFER_ENCODING_8BIT, TRANSFER_ENCODING_BASE64, TRANSFER_ENCODING_QUOTED_PRINTABLE:
+    default:
+        return errors.New("invalid transfer encoding. transferEncoding=" + strconv.Quote(b.TransferEncoding))
+    }
+    if b.Method != "" && !isToken(b.Method) {
+        return errors.New("invalid method. method=" + strconv.Quote(b.Method))
+    }
+    if b.ContentLanguage != "" {
+        for _, tag := range strings.Split(b.ContentLanguage, ",") {
+            if !languageTagRegexp.MatchString(strings.TrimSpace(tag)) {
+                return errors.New("invalid content language. contentLanguage=" + strconv.Quote(b.ContentLanguage))
+            }
+        }
+    }
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the value is a token defined in RFC2045.
+//////////////////////////////////////////////////////////////////////
+func isToken(s string) bool {
+    if s == "" {
+        return false
+    }
+    for _, r := range s {
+        if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?=", r) {
+            return false
+        }
+    }
+    return true
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate the functions available in templates.
+//////////////////////////////////////////////////////////////////////
+func genFuncMap() template.FuncMap {
+    return template.FuncMap{
+        "safeHTML": func(s string) template.HTML { return template.HTML(s) },
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a radom value for boundary.
+// It is read from crypto/rand, so that the boundaries of messages built
+// at the same time never collide. The bytes over the largest multiple of
+// the charset length are skipped to keep the characters uniform.
 //////////////////////////////////////////////////////////////////////
 func genBoundary() string {
     charset := "1234567890abcdefghijklmnopqrstuvwxyz"
-    r := rand.New(rand.NewSource(time.Now().UnixNano()))
-    b := make([]byte, 32)
-    for i := range b {
-        b[i] = charset[r.Intn(len(charset))]
+    max := byte(256 / len(charset) * len(charset))
+    b := make([]byte, 0, 32)
+    buf := make([]byte, 32)
+    for len(b) < cap(b) {
+        if _, err := crand.Read(buf); err != nil {
+            panic("rand.Read() error. err=" + err.Error())
+        }
+        for _, c := range buf {
+            if c < max && len(b) < cap(b) {
+                b = append(b, charset[c % byte(len(charset))])
+            }
+        }
     }
     return string(b)
 }
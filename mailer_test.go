@@ -0,0 +1,627 @@
+//////////////////////////////////////////////////////////////////////
+// mailer_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "net"
+    "net/mail"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// SMTP server for tests, which accepts every command and records the
+// transaction.
+type testSmtpServer struct {
+    data []string
+    extensions []string
+    ln net.Listener
+    mailArgs []string
+    mu sync.Mutex
+    peerCerts [][]*x509.Certificate
+    rcpts []string
+    tlsConfig *tls.Config
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Start the SMTP server for tests on a local port.
+// If tlsConfig is not nil, the connections are implicit TLS.
+//////////////////////////////////////////////////////////////////////
+func startTestSmtpServer(t *testing.T, tlsConfig *tls.Config, extensions ...string) *testSmtpServer {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen() error. err=%v", err)
+    }
+    s := &testSmtpServer{extensions: extensions, ln: ln, tlsConfig: tlsConfig}
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go s.serve(conn)
+        }
+    }()
+    return s
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the port of the server.
+//////////////////////////////////////////////////////////////////////
+func (s *testSmtpServer) port() int {
+    return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Serve a connection.
+//////////////////////////////////////////////////////////////////////
+func (s *testSmtpServer) serve(conn net.Conn) {
+    defer conn.Close()
+    if s.tlsConfig != nil {
+        tlsConn := tls.Server(conn, s.tlsConfig)
+        if err := tlsConn.Handshake(); err != nil {
+            return
+        }
+        s.mu.Lock()
+        s.peerCerts = append(s.peerCerts, tlsConn.ConnectionState().PeerCertificates)
+        s.mu.Unlock()
+        conn = tlsConn
+    }
+    text := textproto.NewConn(conn)
+    text.PrintfLine("220 localhost ESMTP")
+    for {
+        line, err := text.ReadLine()
+        if err != nil {
+            return
+        }
+        verb, arg, _ := strings.Cut(line, " ")
+        switch strings.ToUpper(verb) {
+        case "EHLO":
+            // The first line is the greeting, followed by the extensions.
+            lines := append([]string{"localhost"}, s.extensions...)
+            for i, line := range lines {
+                if i < len(lines) - 1 {
+                    text.PrintfLine("250-%s", line)
+                } else {
+                    text.PrintfLine("250 %s", line)
+                }
+            }
+        case "MAIL":
+            s.mu.Lock()
+            s.mailArgs = append(s.mailArgs, arg)
+            s.mu.Unlock()
+            text.PrintfLine("250 OK")
+        case "RCPT":
+            s.mu.Lock()
+            s.rcpts = append(s.rcpts, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+            s.mu.Unlock()
+            text.PrintfLine("250 OK")
+        case "DATA":
+            text.PrintfLine("354 Go ahead")
+            // The data is read as it is, unlike ReadDotBytes converting CRLF to LF.
+            data := new(strings.Builder)
+            for {
+                line, err := text.R.ReadString('\n')
+                if err != nil {
+                    return
+                }
+                if line == ".\r\n" {
+                    break
+                }
+                data.WriteString(strings.TrimPrefix(line, "."))
+            }
+            s.mu.Lock()
+            s.data = append(s.data, data.String())
+            s.mu.Unlock()
+            text.PrintfLine("250 OK")
+        case "AUTH":
+            text.PrintfLine("235 Authenticated")
+        case "QUIT":
+            text.PrintfLine("221 Bye")
+            return
+        default:
+            text.PrintfLine("250 OK")
+        }
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the recipients and the messages received.
+//////////////////////////////////////////////////////////////////////
+func (s *testSmtpServer) received() ([]string, []string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]string(nil), s.rcpts...), append([]string(nil), s.data...)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the arguments of the MAIL commands received.
+//////////////////////////////////////////////////////////////////////
+func (s *testSmtpServer) mails() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]string(nil), s.mailArgs...)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the certificates presented by the clients of handshakes succeeded.
+//////////////////////////////////////////////////////////////////////
+func (s *testSmtpServer) peers() [][]*x509.Certificate {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([][]*x509.Certificate(nil), s.peerCerts...)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a self-signed certificate and the key in PEM for tests.
+//////////////////////////////////////////////////////////////////////
+func genTestCert(t *testing.T, commonName string) ([]byte, []byte) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("ecdsa.GenerateKey() error. err=%v", err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: commonName},
+        DNSNames: []string{commonName},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf("x509.CreateCertificate() error. err=%v", err)
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatalf("x509.MarshalECPrivateKey() error. err=%v", err)
+    }
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate the TLS config of a server with a certificate for serverName.
+// The certificate PEM is returned to be trusted by the client.
+//////////////////////////////////////////////////////////////////////
+func genTestServerTlsConfig(t *testing.T, serverName string) (*tls.Config, []byte) {
+    t.Helper()
+    certPem, keyPem := genTestCert(t, serverName)
+    cert, err := tls.X509KeyPair(certPem, keyPem)
+    if err != nil {
+        t.Fatalf("tls.X509KeyPair() error. err=%v", err)
+    }
+    return &tls.Config{Certificates: []tls.Certificate{cert}}, certPem
+}
+
+
+func TestBccOnly(t *testing.T) {
+    s := startTestSmtpServer(t, nil)
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.SmtpServerHost = "127.0.0.1"
+    params.SmtpServerPort = s.port()
+    params.Header.To = ""
+    params.Header.Bcc = []string{"bcc1@example.com", "bcc2@example.com"}
+    if err := Send(params); err != nil {
+        t.Fatalf("Send() error. err=%v", err)
+    }
+    rcpts, data := s.received()
+    if want := []string{"bcc1@example.com", "bcc2@example.com"}; !reflect.DeepEqual(rcpts, want) {
+        t.Errorf("recipients=%q, want %q", rcpts, want)
+    }
+    if len(data) != 1 {
+        t.Fatalf("messages=%d, want 1", len(data))
+    }
+    msg, err := mail.ReadMessage(strings.NewReader(data[0]))
+    if err != nil {
+        t.Fatalf("mail.ReadMessage() error. err=%v", err)
+    }
+    // The group syntax with no addresses.
+    if to := msg.Header.Get("To"); to != UNDISCLOSED_RECIPIENTS {
+        t.Errorf("To=%q, want %q", to, UNDISCLOSED_RECIPIENTS)
+    }
+    if list, err := msg.Header.AddressList("To"); err != nil || len(list) != 0 {
+        t.Errorf("To is not an empty group. list=%v, err=%v", list, err)
+    }
+    if bcc := msg.Header.Get("Bcc"); bcc != "" {
+        t.Errorf("Bcc is disclosed. bcc=%q", bcc)
+    }
+}
+
+
+func TestGenBodyFromFilesBom(t *testing.T) {
+    dir := t.TempDir()
+    tests := []struct {
+        name string
+        content string
+    }{
+        {"with BOM", "\xef\xbb\xbfHello {{ .name }}"},
+        {"without BOM", "Hello {{ .name }}"},
+        {"BOM only at the start", "\xef\xbb\xbfHello {{ .name }}\xef\xbb\xbf"},
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fileName := filepath.Join(dir, "body" + strconv.Itoa(i) + ".txt")
+            if err := os.WriteFile(fileName, []byte(tt.content), 0600); err != nil {
+                t.Fatalf("os.WriteFile() error. err=%v", err)
+            }
+            body, err := GenBodyFromFiles(CONTENT_TYPE_TEXT_PLAIN, CHARSET_UTF8, []string{fileName}, map[string]string{"name": "Alice"})
+            if err != nil {
+                t.Fatalf("GenBodyFromFiles() error. err=%v", err)
+            }
+            want := strings.TrimPrefix(strings.ReplaceAll(tt.content, "{{ .name }}", "Alice"), "\xef\xbb\xbf")
+            if body.Data != want {
+                t.Errorf("Data=%q, want %q", body.Data, want)
+            }
+        })
+    }
+}
+
+
+func TestGreetingTimeout(t *testing.T) {
+    // A server which accepts the connection but never greets.
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen() error. err=%v", err)
+    }
+    defer ln.Close()
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+        }
+    }()
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.SmtpServerHost = "127.0.0.1"
+    params.SmtpServerPort = ln.Addr().(*net.TCPAddr).Port
+    params.Timeout = 200 * time.Millisecond
+    done := make(chan error, 1)
+    go func() { done <- Send(params) }()
+    select {
+    case err = <-done:
+        if err == nil {
+            t.Fatal("Send() succeeded without the greeting")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Send() did not time out")
+    }
+}
+
+
+func TestDedupeRecipients(t *testing.T) {
+    tests := []struct {
+        name string
+        rcpts []string
+        want []string
+    }{
+        {"no duplicates", []string{"a@example.com", "b@example.com"}, []string{"a@example.com", "b@example.com"}},
+        {"same address", []string{"a@example.com", "b@example.com", "a@example.com"}, []string{"a@example.com", "b@example.com"}},
+        {"display name", []string{"A <a@example.com>", "a@example.com"}, []string{"A <a@example.com>"}},
+        {"domain case", []string{"a@example.com", "a@EXAMPLE.COM"}, []string{"a@example.com"}},
+        {"local part case", []string{"a@example.com", "A@example.com"}, []string{"a@example.com", "A@example.com"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := dedupeRecipients(tt.rcpts); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("dedupeRecipients()=%q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+
+func TestOverlappingRecipients(t *testing.T) {
+    s := startTestSmtpServer(t, nil)
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.SmtpServerHost = "127.0.0.1"
+    params.SmtpServerPort = s.port()
+    params.Header.To = "A <a@example.com>"
+    params.Header.Cc = []string{"b@example.com", "a@EXAMPLE.COM"}
+    params.Header.Bcc = []string{"b@example.com", "c@example.com"}
+    if err := Send(params); err != nil {
+        t.Fatalf("Send() error. err=%v", err)
+    }
+    rcpts, data := s.received()
+    if want := []string{"a@example.com", "b@example.com", "c@example.com"}; !reflect.DeepEqual(rcpts, want) {
+        t.Errorf("recipients=%q, want %q", rcpts, want)
+    }
+    // The headers are kept as given.
+    msg, err := mail.ReadMessage(strings.NewReader(data[0]))
+    if err != nil {
+        t.Fatalf("mail.ReadMessage() error. err=%v", err)
+    }
+    if to := msg.Header.Get("To"); to != "A <a@example.com>" {
+        t.Errorf("To=%q", to)
+    }
+    if cc := msg.Header.Get("Cc"); cc != "b@example.com, a@EXAMPLE.COM" {
+        t.Errorf("Cc=%q", cc)
+    }
+}
+
+
+func TestTlsServerName(t *testing.T) {
+    // The server is dialed with the IP address, and its certificate is for the name.
+    serverConfig, certPem := genTestServerTlsConfig(t, "mail.example.com")
+    s := startTestSmtpServer(t, serverConfig)
+    roots := x509.NewCertPool()
+    roots.AppendCertsFromPEM(certPem)
+    tests := []struct {
+        name string
+        serverName string
+        wantErr bool
+    }{
+        {"server name of the certificate", "mail.example.com", false},
+        {"dialed host by default", "", true},
+        {"other server name", "other.example.com", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tlsConfig := &tls.Config{ServerName: tt.serverName, RootCAs: roots}
+            params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+            params.SmtpServerHost = "127.0.0.1"
+            params.SmtpServerPort = s.port()
+            params.TlsConfig = tlsConfig
+            err := Send(params)
+            if (err != nil) != tt.wantErr {
+                t.Errorf("Send() error=%v, wantErr %v", err, tt.wantErr)
+            }
+            if tlsConfig.ServerName != tt.serverName {
+                t.Errorf("TlsConfig is modified. serverName=%q", tlsConfig.ServerName)
+            }
+        })
+    }
+}
+
+
+func TestTlsServerNameAuthHost(t *testing.T) {
+    // The client keeps the dialed host, which PLAIN auth is checked against.
+    serverConfig, certPem := genTestServerTlsConfig(t, "mail.example.com")
+    s := startTestSmtpServer(t, serverConfig, "AUTH PLAIN")
+    roots := x509.NewCertPool()
+    roots.AppendCertsFromPEM(certPem)
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.SmtpServerHost = "127.0.0.1"
+    params.SmtpServerPort = s.port()
+    params.TlsConfig = &tls.Config{ServerName: "mail.example.com", RootCAs: roots}
+    params.AuthConfig = GenPlainAuth("user", "password", "127.0.0.1")
+    if err := Send(params); err != nil {
+        t.Errorf("Send() error. err=%v", err)
+    }
+}
+
+
+func TestSetCertPEMStrings(t *testing.T) {
+    certPem, keyPem := genTestCert(t, "mail.example.com")
+    escape := func(b []byte, lineBreak string) string { return strings.ReplaceAll(string(b), "\n", lineBreak) }
+    tests := []struct {
+        name string
+        certPem string
+        keyPem string
+        wantErr bool
+    }{
+        {"PEM", string(certPem), string(keyPem), false},
+        {"escaped LF", escape(certPem, "\\n"), escape(keyPem, "\\n"), false},
+        {"escaped CRLF", escape(certPem, "\\r\\n"), escape(keyPem, "\\r\\n"), false},
+        {"invalid", "invalid", "invalid", true},
+        {"key mismatch", string(certPem), string(keyPem[:len(keyPem) / 2]), true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tlsConfig, err := SetCertPEMStrings(GenTlsConfig("mail.example.com"), tt.certPem, tt.keyPem)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("SetCertPEMStrings() error=%v, wantErr %v", err, tt.wantErr)
+            }
+            if !tt.wantErr && len(tlsConfig.Certificates) != 1 {
+                t.Errorf("certificates=%d, want 1", len(tlsConfig.Certificates))
+            }
+        })
+    }
+}
+
+
+func TestSetRootCAs(t *testing.T) {
+    caPem, _ := genTestCert(t, "mail.example.com")
+    otherPem, _ := genTestCert(t, "other.example.com")
+    block, _ := pem.Decode(caPem)
+    cert, err := x509.ParseCertificate(block.Bytes)
+    if err != nil {
+        t.Fatalf("x509.ParseCertificate() error. err=%v", err)
+    }
+    tlsConfig, err := SetRootCAs(GenTlsConfig("mail.example.com"), otherPem)
+    if err != nil {
+        t.Fatalf("SetRootCAs() error. err=%v", err)
+    }
+    if _, err = cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, DNSName: "mail.example.com"}); err == nil {
+        t.Fatal("certificate is verified with another CA")
+    }
+    // The CA is added into the pool.
+    if tlsConfig, err = SetRootCAs(tlsConfig, caPem); err != nil {
+        t.Fatalf("SetRootCAs() error. err=%v", err)
+    }
+    if _, err = cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, DNSName: "mail.example.com"}); err != nil {
+        t.Errorf("certificate is not verified with the CA. err=%v", err)
+    }
+    if _, err = SetRootCAs(GenTlsConfig("mail.example.com"), []byte("invalid")); err == nil {
+        t.Error("SetRootCAs() succeeded with invalid PEM")
+    }
+
+    dir := t.TempDir()
+    caFile := filepath.Join(dir, "ca.pem")
+    if err = os.WriteFile(caFile, caPem, 0600); err != nil {
+        t.Fatalf("os.WriteFile() error. err=%v", err)
+    }
+    if tlsConfig, err = SetRootCAsFromFile(GenTlsConfig("mail.example.com"), caFile); err != nil {
+        t.Fatalf("SetRootCAsFromFile() error. err=%v", err)
+    }
+    if _, err = cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, DNSName: "mail.example.com"}); err != nil {
+        t.Errorf("certificate is not verified with the CA file. err=%v", err)
+    }
+    if _, err = SetRootCAsFromFile(GenTlsConfig("mail.example.com"), filepath.Join(dir, "none.pem")); err == nil {
+        t.Error("SetRootCAsFromFile() succeeded with a missing file")
+    }
+}
+
+
+func TestSetClientCert(t *testing.T) {
+    serverConfig, serverCertPem := genTestServerTlsConfig(t, "mail.example.com")
+    clientCertPem, clientKeyPem := genTestCert(t, "client.example.com")
+    clientCAs := x509.NewCertPool()
+    clientCAs.AppendCertsFromPEM(clientCertPem)
+    serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+    serverConfig.ClientCAs = clientCAs
+    s := startTestSmtpServer(t, serverConfig)
+
+    dir := t.TempDir()
+    certFile := filepath.Join(dir, "client.pem")
+    keyFile := filepath.Join(dir, "client.key")
+    os.WriteFile(certFile, clientCertPem, 0600)
+    os.WriteFile(keyFile, clientKeyPem, 0600)
+    if _, err := SetClientCert(GenTlsConfig("mail.example.com"), filepath.Join(dir, "none.pem"), keyFile); err == nil {
+        t.Error("SetClientCert() succeeded with a missing file")
+    }
+
+    tests := []struct {
+        name string
+        clientCert bool
+        wantErr bool
+    }{
+        {"with client certificate", true, false},
+        {"without client certificate", false, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tlsConfig, err := SetRootCAs(GenTlsConfig("mail.example.com"), serverCertPem)
+            if err != nil {
+                t.Fatalf("SetRootCAs() error. err=%v", err)
+            }
+            if tt.clientCert {
+                if tlsConfig, err = SetClientCert(tlsConfig, certFile, keyFile); err != nil {
+                    t.Fatalf("SetClientCert() error. err=%v", err)
+                }
+            }
+            params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+            params.SmtpServerHost = "127.0.0.1"
+            params.SmtpServerPort = s.port()
+            params.TlsConfig = tlsConfig
+            err = Send(params)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Send() error=%v, wantErr %v", err, tt.wantErr)
+            }
+        })
+    }
+    peers := s.peers()
+    if len(peers) != 1 || len(peers[0]) != 1 || peers[0][0].Subject.CommonName != "client.example.com" {
+        t.Errorf("client certificate is not presented. peers=%v", peers)
+    }
+}
+
+
+func TestNeedsSmtpUtf8(t *testing.T) {
+    tests := []struct {
+        name string
+        setup func(p *Params)
+        want bool
+    }{
+        {"ascii", func(p *Params) {}, false},
+        {"non-ASCII body", func(p *Params) { p.Body[0].Data = "こんにちは" }, false},
+        {"encoded subject", func(p *Params) { p.Header.Subject = "こんにちは" }, false},
+        {"non-ASCII recipient", func(p *Params) { p.Header.To = "ユーザー@example.jp" }, true},
+        {"non-ASCII from", func(p *Params) { p.Header.From = "送信者@example.jp" }, true},
+        {"non-ASCII extra header", func(p *Params) { p.Header.ExtraHeaders = []*HeaderField{{Name: "X-Note", Value: "メモ"}} }, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "hello"})
+            tt.setup(params)
+            msg, err := composeMessage(params)
+            if err != nil {
+                t.Fatalf("composeMessage() error. err=%v", err)
+            }
+            if got := needsSmtpUtf8(params, msg.header); got != tt.want {
+                t.Errorf("needsSmtpUtf8()=%v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+
+func TestComposeOnce(t *testing.T) {
+    tests := []struct {
+        name string
+        extensions []string
+    }{
+        {"size", []string{"SIZE 10240000"}},
+        {"no size", nil},
+        {"chunking", []string{"CHUNKING"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := startTestSmtpServer(t, nil, tt.extensions...)
+            params := genTestParams(
+                &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "hello"},
+                &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_UTF8, Data: "<p>hello</p>"},
+            )
+            params.SmtpServerHost = "127.0.0.1"
+            params.SmtpServerPort = s.port()
+            params.Attachments = []*Attachment{GenAttachment("a.txt", CONTENT_TYPE_TEXT_PLAIN, []byte("attached"))}
+            // The boundaries get longer on each call, so that a second composition changes the size.
+            calls := 0
+            params.BoundaryGenerator = func() string {
+                calls++
+                return "boundary" + strings.Repeat("x", calls)
+            }
+            if err := Send(params); err != nil {
+                t.Fatalf("Send() error. err=%v", err)
+            }
+            // multipart/mixed and multipart/alternative.
+            if calls != 2 {
+                t.Errorf("boundary generator is called %d times, want 2", calls)
+            }
+            _, data := s.received()
+            if len(data) != 1 {
+                t.Fatalf("messages=%d, want 1", len(data))
+            }
+            mails := s.mails()
+            size := "SIZE=" + strconv.Itoa(len(data[0]))
+            if hasSize := len(tt.extensions) > 0 && strings.HasPrefix(tt.extensions[0], "SIZE"); hasSize != strings.Contains(mails[0], size) {
+                t.Errorf("unexpected MAIL. mail=%q, size=%d", mails[0], len(data[0]))
+            }
+        })
+    }
+}
+
@@ -0,0 +1,1011 @@
+//////////////////////////////////////////////////////////////////////
+// message.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "bytes"
+    crand "crypto/rand"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "mime/quotedprintable"
+    "net/mail"
+    "net/textproto"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+// Message composed once, so that it is written with the same bytes each
+// time, e.g. after counting its size.
+type composedMessage struct {
+    boundaries []string  // Generated on the first write, and reused on the later ones.
+    encrypted []byte  // Output of PgpConfig.Encrypt on the first write.
+    header string  // The header block, generated or raw.
+    params *Params
+}
+
+// Writer keeping the first error, so that a message can be written
+// without checking errors on each write.
+type messageWriter struct {
+    boundaryGenerator func() string
+    boundaryIndex int  // Index of the next boundary of msg to be reused.
+    msg *composedMessage
+    w io.Writer
+    err error
+    lineStart bool  // Whether the last written byte is LF.
+}
+
+// Writer counting the written bytes.
+type countWriter struct {
+    n int
+}
+
+// Writer folding base64 lines at 76 characters.
+type base64LineWriter struct {
+    w io.Writer
+    col int
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Build a composed message.
+//////////////////////////////////////////////////////////////////////
+func BuildMessage(params *Params) ([]byte, error) {
+    buffer := new(bytes.Buffer)
+    if err := WriteMessage(buffer, params); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Build a composed message encoded in base64 without line breaks.
+// e.g.) The raw message of HTTP APIs such as SES SendRawEmail.
+//////////////////////////////////////////////////////////////////////
+func BuildMessageBase64(params *Params) (string, error) {
+    buffer := new(bytes.Buffer)
+    encoder := base64.NewEncoder(base64.StdEncoding, buffer)
+    if err := WriteMessage(encoder, params); err != nil {
+        return "", err
+    }
+    encoder.Close()
+    return buffer.String(), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write a composed message into the writer.
+// e.g.) Piping into "/usr/sbin/sendmail -t", or archiving into a file.
+// Each part is written incrementally, without building the whole message.
+//////////////////////////////////////////////////////////////////////
+func WriteMessage(w io.Writer, params *Params) error {
+    msg, err := composeMessage(params)
+    if err != nil {
+        return err
+    }
+    return msg.writeTo(w)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate the content, and compose the header block.
+// The content is written by writeTo().
+//////////////////////////////////////////////////////////////////////
+func composeMessage(params *Params) (*composedMessage, error) {
+    for _, b := range params.Body {
+        if err := validateBody(b); err != nil {
+            return nil, err
+        }
+    }
+    for _, a := range params.Attachments {
+        if mime.FormatMediaType(a.ContentType, nil) == "" {
+            return nil, errors.New("invalid content type. contentType=" + strconv.Quote(a.ContentType))
+        }
+        if err := validateAttachmentEncoding(a); err != nil {
+            return nil, err
+        }
+        if a.reader != nil && (a.Gzip || params.PgpConfig != nil) {
+            return nil, errors.New("attachment reader can not be used with Gzip or PgpConfig. fileName=" + a.FileName)
+        }
+    }
+    for _, img := range params.InlineImages {
+        if mime.FormatMediaType(img.ContentType, nil) == "" {
+            return nil, errors.New("invalid content type. contentType=" + strconv.Quote(img.ContentType))
+        }
+        if img.ContentID == "" {
+            return nil, errors.New("inline image content ID is empty. fileName=" + img.FileName)
+        }
+    }
+    msg := &composedMessage{header: params.rawHeader, params: params}
+    if msg.header == "" {
+        headers, err := genHeaders(params)
+        if err != nil {
+            return nil, err
+        }
+        for _, f := range headers {
+            // A line break in a value would end the header block early.
+            if !isFoldedHeaderValue(f.Value) {
+                return nil, errors.New("invalid header value. name=" + f.Name + ", value=" + strconv.Quote(f.Value))
+            }
+            msg.header += f.Name + ": " + f.Value + "\r\n"
+        }
+    }
+    return msg, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write the message into the writer.
+// The boundaries and the encrypted content are the same on every write.
+//////////////////////////////////////////////////////////////////////
+func (msg *composedMessage) writeTo(w io.Writer) error {
+    mw := &messageWriter{boundaryGenerator: msg.params.BoundaryGenerator, msg: msg, w: w}
+    mw.writeString(msg.header)
+    if msg.params.PgpConfig != nil {
+        if err := writePgpEncrypted(mw, msg.params.PgpConfig, msg.params); err != nil {
+            return err
+        }
+    } else {
+        writeContent(mw, msg.params)
+    }
+    if mw.err != nil {
+        return fmt.Errorf("(io.Writer) Write() error. err=%w", mw.err)
+    }
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the size of the message in bytes without sending it.
+//////////////////////////////////////////////////////////////////////
+func (msg *composedMessage) size() (int, error) {
+    cw := &countWriter{}
+    if err := msg.writeTo(cw); err != nil {
+        return 0, err
+    }
+    return cw.n, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate the message headers except the ones of the content.
+// The order is fixed: From, To, Cc, Subject, Date, Message-ID,
+// MIME-Version, the other generated ones, and then ExtraHeaders as given.
+//////////////////////////////////////////////////////////////////////
+func genHeaders(params *Params) ([]*HeaderField, error) {
+    headers := make([]*HeaderField, 0)
+    add := func(name string, value string) {
+        headers = append(headers, &HeaderField{Name: name, Value: value})
+    }
+    add("From", foldAddressList("From", []string{params.Header.From}))
+    to := addressList(params.Header.To, nil, params.Header.ToGroups)
+    cc := addressList("", params.Header.Cc, params.Header.CcGroups)
+    if len(to) > 0 {
+        add("To", foldAddressList("To", to))
+    } else if len(cc) == 0 {
+        // Only Bcc recipients, which must not be disclosed.
+        add("To", UNDISCLOSED_RECIPIENTS)
+    }
+    if len(cc) > 0 {
+        add("Cc", foldAddressList("Cc", cc))
+    }
+    subject, err := encodeSubject(params.Header.Subject, params.Header.SubjectEncoding)
+    if err != nil {
+        return nil, err
+    }
+    add("Subject", subject)
+    date := params.Header.Date
+    if date.IsZero() {
+        date = time.Now()
+    }
+    add("Date", date.Format(time.RFC1123Z))
+    messageID := params.Header.MessageID
+    if messageID == "" {
+        if messageID, err = genMessageID(params.Header.From); err != nil {
+            return nil, err
+        }
+    }
+    if messageID, err = formatMessageID(messageID); err != nil {
+        return nil, err
+    }
+    add("Message-ID", messageID)
+    if usesMime(params) {
+        mimeVersion := params.Header.MimeVersion
+        if mimeVersion == "" {
+            mimeVersion = MIME_VERSION_1_0
+        }
+        add("MIME-Version", mimeVersion)
+    }
+    if params.Header.ReplyTo != "" {
+        add("Reply-To", foldAddressList("Reply-To", []string{params.Header.ReplyTo}))
+    }
+    if params.Header.Sender == "" && isMultiFrom(params.Header.From) {
+        return nil, errors.New("Sender is required for multiple From. from=" + strconv.Quote(params.Header.From))
+    }
+    if params.Header.Sender != "" {
+        sender, err := mail.ParseAddress(params.Header.Sender)
+        if err != nil {
+            return nil, errors.New("invalid sender. sender=" + strconv.Quote(params.Header.Sender) + " err=" + err.Error())
+        }
+        if sender.Address != addrSpec(params.Header.From) {
+            add("Sender", params.Header.Sender)
+        }
+    }
+    if params.Header.InReplyTo != "" {
+        id, err := formatMessageID(params.Header.InReplyTo)
+        if err != nil {
+            return nil, err
+        }
+        add("In-Reply-To", id)
+    }
+    if len(params.Header.References) > 0 {
+        ids := make([]string, 0, len(params.Header.References))
+        for _, ref := range params.Header.References {
+            id, err := formatMessageID(ref)
+            if err != nil {
+                return nil, err
+            }
+            ids = append(ids, id)
+        }
+        add("References", strings.Join(ids, "\r\n "))
+    }
+    if params.Header.Organization != "" {
+        add("Organization", mime.QEncoding.Encode(CHARSET_UTF8, params.Header.Organization))
+    }
+    if params.Header.Comments != "" {
+        add("Comments", mime.QEncoding.Encode(CHARSET_UTF8, params.Header.Comments))
+    }
+    if len(params.Header.Keywords) > 0 {
+        // Each keyword is a phrase, so that it is encoded separately.
+        keywords := make([]string, 0, len(params.Header.Keywords))
+        for _, keyword := range params.Header.Keywords {
+            keywords = append(keywords, mime.QEncoding.Encode(CHARSET_UTF8, keyword))
+        }
+        add("Keywords", strings.Join(keywords, ", "))
+    }
+    if params.Header.Priority != "" {
+        values, ok := priorityHeaders[params.Header.Priority]
+        if !ok {
+            return nil, errors.New("invalid priority. priority=" + strconv.Quote(params.Header.Priority))
+        }
+        add("Importance", values[0])
+        add("X-Priority", values[1])
+        // Outlook reads X-MSMail-Priority.
+        add("X-MSMail-Priority", values[2])
+    }
+    if params.Header.AutoSubmitted != "" {
+        add("Auto-Submitted", params.Header.AutoSubmitted)
+    }
+    if params.Header.AutoResponseSuppress != "" {
+        for _, value := range strings.Split(params.Header.AutoResponseSuppress, ",") {
+            if !isToken(strings.TrimSpace(value)) {
+                return nil, errors.New("invalid auto response suppress. autoResponseSuppress=" + strconv.Quote(params.Header.AutoResponseSuppress))
+            }
+        }
+        add("X-Auto-Response-Suppress", params.Header.AutoResponseSuppress)
+    }
+    if !params.Header.DeferUntil.IsZero() {
+        if !params.Header.DeferUntil.After(time.Now()) {
+            return nil, errors.New("deferred delivery time is not in the future. deferUntil=" + params.Header.DeferUntil.String())
+        }
+        add("Deferred-Delivery", params.Header.DeferUntil.Format(time.RFC1123Z))
+    }
+    if !params.Header.ExpiryDate.IsZero() {
+        if !params.Header.ExpiryDate.After(time.Now()) {
+            return nil, errors.New("expiry date is not in the future. expiryDate=" + params.Header.ExpiryDate.String())
+        }
+        add("Expiry-Date", params.Header.ExpiryDate.Format(time.RFC1123Z))
+    }
+    if params.Header.IdempotencyKey != "" {
+        if !isToken(params.Header.IdempotencyKey) {
+            return nil, errors.New("invalid idempotency key. idempotencyKey=" + strconv.Quote(params.Header.IdempotencyKey))
+        }
+        add(idempotencyKeyHeader, params.Header.IdempotencyKey)
+    }
+    if params.Header.XMailer != "" {
+        add("X-Mailer", params.Header.XMailer)
+    } else if defaultXMailer {
+        add("X-Mailer", "go_mailer/" + VERSION)
+    }
+    for _, f := range params.Header.ExtraHeaders {
+        if err := validateHeaderField(f); err != nil {
+            return nil, err
+        }
+        headers = append(headers, f)
+    }
+    return headers, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Encode the subject in RFC2047 if it has non-ASCII characters.
+// With SUBJECT_ENCODING_AUTO, Q-encoding is used if it is not longer than
+// B-encoding, i.e. the subject is mostly ASCII.
+//////////////////////////////////////////////////////////////////////
+func encodeSubject(subject string, encoding string) (string, error) {
+    switch encoding {
+    case SUBJECT_ENCODING_AUTO:
+        special := 0
+        for i := 0; i < len(subject); i++ {
+            c := subject[i]
+            if c >= 0x80 || c < ' ' || c == '=' || c == '?' || c == '_' {
+                special++
+            }
+        }
+        // Each special byte is "=XX" in Q, and B is 4 bytes per 3 bytes.
+        if len(subject) + special * 2 <= (len(subject) + 2) / 3 * 4 {
+            return mime.QEncoding.Encode(CHARSET_UTF8, subject), nil
+        }
+        return mime.BEncoding.Encode(CHARSET_UTF8, subject), nil
+    case SUBJECT_ENCODING_B:
+        return mime.BEncoding.Encode(CHARSET_UTF8, subject), nil
+    case SUBJECT_ENCODING_Q:
+        return mime.QEncoding.Encode(CHARSET_UTF8, subject), nil
+    }
+    return "", errors.New("invalid subject encoding. subjectEncoding=" + strconv.Quote(encoding))
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the message uses MIME features, which require MIME-Version.
+// A single text/plain body in us-ascii and 7bit is a plain RFC5322
+// message. Any other charset needs MIME-Version, or else it is read as
+// us-ascii (RFC2045).
+//////////////////////////////////////////////////////////////////////
+func usesMime(params *Params) bool {
+    if params.PgpConfig != nil || len(params.Attachments) > 0 || len(params.InlineImages) > 0 {
+        return true
+    }
+    bodies := composeBodies(params)
+    if len(bodies) != 1 {
+        return true
+    }
+    b := bodies[0]
+    data, err := encodeCharset(b.Charset, b.Data)
+    if err != nil {
+        return true
+    }
+    return b.ContentType != CONTENT_TYPE_TEXT_PLAIN || !strings.EqualFold(b.Charset, CHARSET_US_ASCII) || !strings.EqualFold(b.transferEncoding(data), TRANSFER_ENCODING_7BIT)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate an extra header field.
+// The content headers are composed by this package, so they can not be
+// given.
+//////////////////////////////////////////////////////////////////////
+func validateHeaderField(f *HeaderField) error {
+    if f.Name == "" || strings.IndexFunc(f.Name, func(r rune) bool { return r < 33 || r > 126 || r == ':' }) >= 0 {
+        return errors.New("invalid header name. name=" + strconv.Quote(f.Name))
+    }
+    switch textproto.CanonicalMIMEHeaderKey(f.Name) {
+    case "Content-Type", "Content-Transfer-Encoding", "Mime-Version":
+        return errors.New("extra headers must not have content headers. name=" + f.Name)
+    case "Date", "Message-Id":
+        return errors.New("extra headers must not have Date or Message-ID, which are set by Header.Date and Header.MessageID. name=" + f.Name)
+    }
+    if !isFoldedHeaderValue(f.Value) {
+        return errors.New("invalid header value. name=" + f.Name + ", value=" + strconv.Quote(f.Value))
+    }
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the header value has no line breaks except folding ones,
+// i.e. CRLF followed by a space or a tab.
+//////////////////////////////////////////////////////////////////////
+func isFoldedHeaderValue(v string) bool {
+    for i := 0; i < len(v); i++ {
+        switch v[i] {
+        case '\r':
+            if i + 2 >= len(v) || v[i + 1] != '\n' || (v[i + 2] != ' ' && v[i + 2] != '\t') {
+                return false
+            }
+            i++
+        case '\n':
+            return false
+        }
+    }
+    return true
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Join the addresses and the groups into an address list.
+//////////////////////////////////////////////////////////////////////
+func addressList(addr string, addrs []string, groups []*Group) []string {
+    list := make([]string, 0)
+    if addr != "" {
+        list = append(list, addr)
+    }
+    list = append(list, addrs...)
+    for _, g := range groups {
+        list = append(list, g.String())
+    }
+    return list
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Fold the address list of the header so that the lines fit in 78
+// characters where possible. It is folded between the addresses, and an
+// address too long for a line is folded at its own whitespace.
+//////////////////////////////////////////////////////////////////////
+func foldAddressList(name string, list []string) string {
+    folded := ""
+    lineLen := len(name) + len(": ")
+    for i, addr := range list {
+        if i > 0 {
+            folded += ","
+            lineLen++
+            if lineLen + len(" ") + len(addr) + len(",") > 78 {
+                folded += "\r\n"
+                lineLen = 0
+            }
+            folded += " "
+            lineLen++
+        }
+        words := addressWords(addr)
+        for j, word := range words {
+            tail := 0
+            if i < len(list) - 1 && j == len(words) - 1 {
+                tail = len(",")
+            }
+            // The first word keeps the line from being whitespace only.
+            if j > 0 && lineLen + len(word) + tail > 78 {
+                folded += "\r\n"
+                lineLen = 0
+            }
+            folded += word
+            lineLen += len(word)
+        }
+    }
+    return folded
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Split the address at the whitespace where it may be folded.
+// Each word but the first one begins with the whitespace. Quoted
+// strings, comments and angle addresses are never split, and neither
+// are encoded-words since they contain no whitespace.
+//////////////////////////////////////////////////////////////////////
+func addressWords(addr string) []string {
+    words := make([]string, 0)
+    start := 0
+    quoted := false
+    escaped := false
+    depth := 0
+    for i := 0; i < len(addr); i++ {
+        ch := addr[i]
+        switch {
+        case escaped:
+            escaped = false
+        case ch == '\\' && (quoted || depth > 0):
+            escaped = true
+        case ch == '"' && depth == 0:
+            quoted = !quoted
+        case quoted:
+        case ch == '(' || ch == '<':
+            depth++
+        case (ch == ')' || ch == '>') && depth > 0:
+            depth--
+        case (ch == ' ' || ch == '\t') && depth == 0 && i > start && addr[i - 1] != ' ' && addr[i - 1] != '\t':
+            words = append(words, addr[start:i])
+            start = i
+        }
+    }
+    return append(words, addr[start:])
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a unique message ID with the domain of the From address.
+//////////////////////////////////////////////////////////////////////
+func genMessageID(from string) (string, error) {
+    domain := "localhost"
+    if addrs, err := mail.ParseAddressList(from); err == nil && len(addrs) > 0 {
+        if i := strings.LastIndex(addrs[0].Address, "@"); i >= 0 && i < len(addrs[0].Address) - 1 {
+            domain = addrs[0].Address[i + 1:]
+        }
+    }
+    b := make([]byte, 16)
+    if _, err := crand.Read(b); err != nil {
+        return "", errors.New("rand.Read() error. err=" + err.Error())
+    }
+    return "<" + hex.EncodeToString(b) + "@" + domain + ">", nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Format the message ID as "<id-left@id-right>".
+//////////////////////////////////////////////////////////////////////
+func formatMessageID(id string) (string, error) {
+    s := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+    at := strings.Index(s, "@")
+    if at <= 0 || at == len(s) - 1 || strings.Count(s, "@") != 1 || strings.ContainsAny(s, "<> \t\r\n\"") {
+        return "", errors.New("invalid message ID. id=" + strconv.Quote(id))
+    }
+    return "<" + s + ">", nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the size of the composed message in bytes, as sent in DATA.
+// Attachments are counted after base64 encoding.
+//////////////////////////////////////////////////////////////////////
+func MessageSize(params *Params) (int, error) {
+    msg, err := composeMessage(params)
+    if err != nil {
+        return 0, err
+    }
+    return msg.size()
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write the content, which is the MIME entity following the message
+// headers.
+//////////////////////////////////////////////////////////////////////
+func writeContent(mw *messageWriter, params *Params) {
+    bodies := composeBodies(params)
+    if len(params.Attachments) > 0 {
+        boundary := mw.boundary()
+        mw.writeString("Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n")
+        mw.writeString("--" + boundary + "\r\n")
+        writeRelated(mw, bodies, params.InlineImages)
+        for _, a := range params.Attachments {
+            mw.writeString("--" + boundary + "\r\n")
+            writeAttachment(mw, a)
+        }
+        mw.writeString("--" + boundary + "--\r\n")
+    } else if len(params.InlineImages) == 0 && len(bodies) == 1 {
+        // The body is the whole content, so that it is kept as it is
+        // without an extra line break at the end.
+        writeBody(mw, bodies[0])
+        mw.endLine()
+    } else {
+        writeRelated(mw, bodies, params.InlineImages)
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write bodies with the inline images.
+// If there are inline images, they are composed as multipart/related
+// with the bodies as the root.
+//////////////////////////////////////////////////////////////////////
+func writeRelated(mw *messageWriter, bodies []*Body, images []*InlineImage) {
+    if len(images) == 0 {
+        writeBodies(mw, bodies)
+        return
+    }
+    rootType := "multipart/alternative"
+    if len(bodies) == 1 {
+        rootType = bodies[0].ContentType
+    }
+    boundary := mw.boundary()
+    mw.writeString("Content-Type: multipart/related; type=\"" + rootType + "\"; boundary=\"" + boundary + "\"\r\n\r\n")
+    mw.writeString("--" + boundary + "\r\n")
+    writeBodies(mw, bodies)
+    for _, img := range images {
+        mw.writeString("--" + boundary + "\r\n")
+        writeInlineImage(mw, img)
+    }
+    mw.writeString("--" + boundary + "--\r\n")
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write bodies.
+// If bodies are 2 or more, they are composed as multipart/alternative.
+//////////////////////////////////////////////////////////////////////
+func writeBodies(mw *messageWriter, bodies []*Body) {
+    var boundary string
+    if len(bodies) > 1 {
+        boundary = mw.boundary()
+        mw.writeString("Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n")
+    }
+    for _, b := range bodies {
+        if len(bodies) > 1 {
+            mw.writeString("--" + boundary + "\r\n")
+        }
+        writeBody(mw, b)
+        // The line break before the delimiter belongs to the delimiter.
+        mw.writeString("\r\n")
+    }
+    if len(bodies) > 1 {
+        mw.writeString("--" + boundary + "--\r\n")
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write a body part.
+//////////////////////////////////////////////////////////////////////
+func writeBody(mw *messageWriter, b *Body) {
+    data, err := encodeCharset(b.Charset, b.Data)
+    if err != nil {
+        if mw.err == nil {
+            mw.err = err
+        }
+        return
+    }
+    encoding := b.transferEncoding(data)
+    contentType := b.ContentType + "; charset=\"" + b.Charset + "\""
+    if b.Method != "" {
+        contentType += "; method=" + b.Method
+    }
+    mw.writeString("Content-Type: " + contentType + "\r\n")
+    if b.ContentLanguage != "" {
+        mw.writeString("Content-Language: " + b.ContentLanguage + "\r\n")
+    }
+    writeDescription(mw, b.Description)
+    mw.writeString("Content-Transfer-Encoding: " + encoding + "\r\n")
+    mw.writeString("\r\n")
+    writeEncoded(mw, encoding, data)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the transfer encoding of the body with the data in its charset.
+//////////////////////////////////////////////////////////////////////
+func (b *Body) transferEncoding(data []byte) string {
+    if b.TransferEncoding != "" {
+        return b.TransferEncoding
+    }
+    if b.AutoEncode {
+        return selectTransferEncoding(string(data))
+    }
+    return DetectTransferEncoding(data)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Select the transfer encoding for the data.
+//     - 7bit: Pure ASCII.
+//     - quoted-printable: Mostly ASCII UTF-8.
+//     - base64: Mostly non-ASCII, or binary-ish.
+//////////////////////////////////////////////////////////////////////
+func selectTransferEncoding(data string) string {
+    if !utf8.ValidString(data) {
+        return TRANSFER_ENCODING_BASE64
+    }
+    nonAscii := 0
+    for i := 0; i < len(data); i++ {
+        if data[i] == 0 {
+            return TRANSFER_ENCODING_BASE64
+        }
+        if data[i] >= 0x80 {
+            nonAscii++
+        }
+    }
+    // Quoted-printable triples each non-ASCII byte while base64 grows the whole by 4/3.
+    if nonAscii * 6 > len(data) {
+        return TRANSFER_ENCODING_BASE64
+    }
+    if nonAscii > 0 {
+        return TRANSFER_ENCODING_QUOTED_PRINTABLE
+    }
+    // Lines longer than 998 characters are not allowed in 7bit.
+    for _, line := range strings.Split(data, "\n") {
+        if len(line) > 998 {
+            return TRANSFER_ENCODING_QUOTED_PRINTABLE
+        }
+    }
+    return TRANSFER_ENCODING_7BIT
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Detect the transfer encoding with which the data can be sent as it is.
+//     - 7bit: Pure ASCII.
+//     - 8bit: Non-ASCII.
+//     - base64: NUL, or lines longer than 998 characters.
+// Unlike AutoEncode, quoted-printable is never selected.
+//////////////////////////////////////////////////////////////////////
+func DetectTransferEncoding(data []byte) string {
+    encoding := TRANSFER_ENCODING_7BIT
+    lineLen := 0
+    for _, c := range data {
+        switch {
+        case c == 0:
+            return TRANSFER_ENCODING_BASE64
+        case c == '\n':
+            lineLen = 0
+            continue
+        case c >= 0x80:
+            encoding = TRANSFER_ENCODING_8BIT
+        }
+        if c != '\r' {
+            lineLen++
+        }
+        if lineLen > 998 {
+            return TRANSFER_ENCODING_BASE64
+        }
+    }
+    return encoding
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write an attachment part.
+// The cached encoding is used if the attachment has been encoded.
+// With Gzip, the data is compressed per message unless it is cached.
+//////////////////////////////////////////////////////////////////////
+func writeAttachment(mw *messageWriter, a *Attachment) {
+    encoding := a.transferEncoding()
+    mw.writeString("Content-Type: " + mime.FormatMediaType(a.contentType(), map[string]string{"name": a.fileName()}) + "\r\n")
+    mw.writeString("Content-Transfer-Encoding: " + encoding + "\r\n")
+    writeDescription(mw, a.Description)
+    disposition := "attachment"
+    if a.Inline {
+        disposition = "inline"
+    }
+    mw.writeString("Content-Disposition: " + mime.FormatMediaType(disposition, map[string]string{"filename": a.fileName()}) + "\r\n\r\n")
+    if a.reader != nil {
+        writeReader(mw, a)
+    } else if a.encoded != "" && a.encodedAs == a.encodingKey() {
+        mw.writeString(a.encoded)
+    } else {
+        writeEncoded(mw, encoding, a.data())
+    }
+    mw.writeString("\r\n")
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write the attachment reader with base64.
+// When counting the message size, only the size is counted without
+// reading it.
+//////////////////////////////////////////////////////////////////////
+func writeReader(mw *messageWriter, a *Attachment) {
+    if cw, ok := mw.w.(*countWriter); ok {
+        encoded := int((a.readerSize + 2) / 3 * 4)
+        if encoded > 0 {
+            // CRLF between the lines of 76 characters.
+            encoded += (encoded - 1) / 76 * 2
+        }
+        cw.n += encoded
+        mw.lineStart = false
+        return
+    }
+    enc := base64.NewEncoder(base64.StdEncoding, &base64LineWriter{w: mw})
+    n, err := io.Copy(enc, io.LimitReader(a.reader, a.readerSize))
+    enc.Close()
+    if mw.err != nil {
+        return
+    }
+    if err != nil {
+        mw.err = errors.New("attachment reader error. fileName=" + a.FileName + ", err=" + err.Error())
+    } else if n < a.readerSize {
+        mw.err = errors.New("attachment reader returned fewer bytes than the size. fileName=" + a.FileName + ", size=" + strconv.FormatInt(a.readerSize, 10) + ", read=" + strconv.FormatInt(n, 10))
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate that the attachment data can be sent with its transfer encoding.
+//////////////////////////////////////////////////////////////////////
+func validateAttachmentEncoding(a *Attachment) error {
+    encoding := a.transferEncoding()
+    switch encoding {
+    case TRANSFER_ENCODING_BASE64, TRANSFER_ENCODING_QUOTED_PRINTABLE:
+        if strings.EqualFold(a.ContentType, CONTENT_TYPE_MESSAGE_RFC822) {
+            // RFC2046 5.2.1
+            return errors.New("message/rfc822 can not be sent as " + encoding + ". fileName=" + a.FileName)
+        }
+        return nil
+    case TRANSFER_ENCODING_BINARY:
+        return nil
+    case TRANSFER_ENCODING_7BIT, TRANSFER_ENCODING_8BIT:
+        detected := DetectTransferEncoding(a.Data)
+        if detected == TRANSFER_ENCODING_BASE64 || (encoding == TRANSFER_ENCODING_7BIT && detected != TRANSFER_ENCODING_7BIT) {
+            return errors.New("attachment data can not be sent as " + encoding + ". fileName=" + a.FileName)
+        }
+        return nil
+    }
+    return errors.New("invalid transfer encoding. transferEncoding=" + strconv.Quote(encoding))
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write the Content-Description header if the description is not empty.
+// Non-ASCII is encoded in RFC2047.
+//////////////////////////////////////////////////////////////////////
+func writeDescription(mw *messageWriter, description string) {
+    if description != "" {
+        mw.writeString("Content-Description: " + mime.QEncoding.Encode(CHARSET_UTF8, description) + "\r\n")
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write data encoded with the transfer encoding.
+// The data is written as it is with CRLF line endings for 7bit, 8bit or
+// empty encoding.
+//////////////////////////////////////////////////////////////////////
+func writeEncoded(w io.Writer, encoding string, data []byte) {
+    switch encoding {
+    case TRANSFER_ENCODING_BASE64:
+        writeBase64(w, data)
+    case TRANSFER_ENCODING_QUOTED_PRINTABLE:
+        qw := quotedprintable.NewWriter(w)
+        qw.Write(data)
+        qw.Close()
+    case TRANSFER_ENCODING_BINARY:
+        w.Write(data)
+    default:
+        w.Write(normalizeCRLF(data))
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Normalize line endings (bare LF or CR) into CRLF.
+//////////////////////////////////////////////////////////////////////
+func normalizeCRLF(data []byte) []byte {
+    if !bytes.ContainsAny(data, "\r\n") {
+        return data
+    }
+    normalized := make([]byte, 0, len(data) + len(data) / 32)
+    for i := 0; i < len(data); i++ {
+        switch data[i] {
+        case '\r':
+            normalized = append(normalized, '\r', '\n')
+            if i + 1 < len(data) && data[i + 1] == '\n' {
+                i++
+            }
+        case '\n':
+            normalized = append(normalized, '\r', '\n')
+        default:
+            normalized = append(normalized, data[i])
+        }
+    }
+    return normalized
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write an inline image part.
+//////////////////////////////////////////////////////////////////////
+func writeInlineImage(mw *messageWriter, img *InlineImage) {
+    mw.writeString("Content-Type: " + mime.FormatMediaType(img.ContentType, map[string]string{"name": img.FileName}) + "\r\n")
+    mw.writeString("Content-Transfer-Encoding: base64\r\n")
+    mw.writeString("Content-ID: <" + img.ContentID + ">\r\n")
+    writeDescription(mw, img.Description)
+    mw.writeString("Content-Disposition: " + mime.FormatMediaType("inline", map[string]string{"filename": img.FileName}) + "\r\n\r\n")
+    writeBase64(mw, img.Data)
+    mw.writeString("\r\n")
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Encode data into base64 folded at 76 characters per line (RFC2045).
+// The lines are separated by CRLF, and there is no CRLF after the last.
+//////////////////////////////////////////////////////////////////////
+func EncodeBase64MIME(data []byte) string {
+    buffer := new(bytes.Buffer)
+    writeBase64(buffer, data)
+    return buffer.String()
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write data encoded into base64 folded at 76 characters per line.
+//////////////////////////////////////////////////////////////////////
+func writeBase64(w io.Writer, data []byte) error {
+    enc := base64.NewEncoder(base64.StdEncoding, &base64LineWriter{w: w})
+    if _, err := enc.Write(data); err != nil {
+        return err
+    }
+    return enc.Close()
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write with folding lines.
+// CRLF is written only before continuing lines, not after the last one.
+//////////////////////////////////////////////////////////////////////
+func (lw *base64LineWriter) Write(p []byte) (int, error) {
+    n := 0
+    for len(p) > 0 {
+        if lw.col == 76 {
+            if _, err := io.WriteString(lw.w, "\r\n"); err != nil {
+                return n, err
+            }
+            lw.col = 0
+        }
+        chunk := 76 - lw.col
+        if chunk > len(p) {
+            chunk = len(p)
+        }
+        m, err := lw.w.Write(p[:chunk])
+        n += m
+        lw.col += m
+        if err != nil {
+            return n, err
+        }
+        p = p[chunk:]
+    }
+    return n, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write unless an error has occurred.
+//////////////////////////////////////////////////////////////////////
+func (mw *messageWriter) Write(p []byte) (int, error) {
+    if mw.err != nil {
+        return 0, mw.err
+    }
+    n, err := mw.w.Write(p)
+    mw.err = err
+    if n > 0 {
+        mw.lineStart = p[n - 1] == '\n'
+    }
+    return n, err
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write a string unless an error has occurred.
+//////////////////////////////////////////////////////////////////////
+func (mw *messageWriter) writeString(s string) {
+    io.WriteString(mw, s)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Terminate the last line unless it has been terminated.
+//////////////////////////////////////////////////////////////////////
+func (mw *messageWriter) endLine() {
+    if !mw.lineStart {
+        mw.writeString("\r\n")
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a MIME boundary with the generator if any.
+// The boundaries of the composed message are generated only on the first
+// write, so that the size counted beforehand does not change.
+//////////////////////////////////////////////////////////////////////
+func (mw *messageWriter) boundary() string {
+    if mw.msg != nil && mw.boundaryIndex < len(mw.msg.boundaries) {
+        mw.boundaryIndex++
+        return mw.msg.boundaries[mw.boundaryIndex - 1]
+    }
+    var boundary string
+    if mw.boundaryGenerator != nil {
+        boundary = mw.boundaryGenerator()
+    } else {
+        boundary = genBoundary()
+    }
+    if mw.msg != nil {
+        mw.msg.boundaries = append(mw.msg.boundaries, boundary)
+        mw.boundaryIndex++
+    }
+    return boundary
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Count the bytes.
+//////////////////////////////////////////////////////////////////////
+func (cw *countWriter) Write(p []byte) (int, error) {
+    cw.n += len(p)
+    return len(p), nil
+}
@@ -0,0 +1,875 @@
+//////////////////////////////////////////////////////////////////////
+// message_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/base64"
+    "io"
+    "mime"
+    "mime/multipart"
+    "mime/quotedprintable"
+    "net/mail"
+    "net/textproto"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Params Struct for tests.
+//////////////////////////////////////////////////////////////////////
+func genTestParams(bodies ...*Body) *Params {
+    return &Params{
+        SmtpServerHost: "localhost",
+        SmtpServerPort: 25,
+        Header: &Header{From: "from@example.com", To: "to@example.com", Subject: "subject"},
+        Body: bodies,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Build the message and read it with net/mail.
+//////////////////////////////////////////////////////////////////////
+func readTestMessage(t *testing.T, params *Params) *mail.Message {
+    t.Helper()
+    b, err := BuildMessage(params)
+    if err != nil {
+        t.Fatalf("BuildMessage() error. err=%v", err)
+    }
+    msg, err := mail.ReadMessage(bytes.NewReader(b))
+    if err != nil {
+        t.Fatalf("mail.ReadMessage() error. err=%v, message=%q", err, b)
+    }
+    return msg
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Split the message into the header block and the content.
+//////////////////////////////////////////////////////////////////////
+func splitTestMessage(t *testing.T, params *Params) (string, string) {
+    t.Helper()
+    b, err := BuildMessage(params)
+    if err != nil {
+        t.Fatalf("BuildMessage() error. err=%v", err)
+    }
+    header, content, ok := strings.Cut(string(b), "\r\n\r\n")
+    if !ok {
+        t.Fatalf("no blank line after the headers. message=%q", b)
+    }
+    return header + "\r\n", content
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the names of the header fields in order.
+//////////////////////////////////////////////////////////////////////
+func testHeaderNames(header string) []string {
+    names := make([]string, 0)
+    for _, line := range strings.Split(strings.TrimSuffix(header, "\r\n"), "\r\n") {
+        if line != "" && line[0] != ' ' && line[0] != '\t' {
+            name, _, _ := strings.Cut(line, ":")
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+
+func TestMultipleFrom(t *testing.T) {
+    from := []string{"Alice <alice@example.com>", "bob@example.com"}
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.Header = GenHeaderMultiFrom(from, "", "to@example.com", "subject", MIME_VERSION_1_0)
+    if b, err := BuildMessage(params); err == nil {
+        t.Fatalf("BuildMessage() succeeded without Sender. message=%q", b)
+    }
+
+    params.Header = GenHeaderMultiFrom(from, "alice@example.com", "to@example.com", "subject", MIME_VERSION_1_0)
+    msg := readTestMessage(t, params)
+    list, err := msg.Header.AddressList("From")
+    if err != nil || len(list) != 2 || list[0].Address != "alice@example.com" || list[1].Address != "bob@example.com" {
+        t.Errorf("unexpected From. from=%q, err=%v", msg.Header.Get("From"), err)
+    }
+    if sender := msg.Header.Get("Sender"); sender != "alice@example.com" {
+        t.Errorf("Sender=%q, want %q", sender, "alice@example.com")
+    }
+    if envelopeFrom(params) != "alice@example.com" {
+        t.Errorf("envelope from=%q, want the sender", envelopeFrom(params))
+    }
+}
+
+
+func TestEncodeBase64MIME(t *testing.T) {
+    // 57 bytes are encoded into a line of 76 characters.
+    for _, n := range []int{0, 1, 2, 3, 56, 57, 58, 113, 114, 115, 1000} {
+        data := make([]byte, n)
+        for i := range data {
+            data[i] = byte(i * 7)
+        }
+        encoded := EncodeBase64MIME(data)
+        if n == 0 && encoded != "" {
+            t.Errorf("encoded empty data=%q", encoded)
+        }
+        if strings.HasSuffix(encoded, "\r\n") {
+            t.Errorf("CRLF after the last line. n=%d", n)
+        }
+        lines := strings.Split(encoded, "\r\n")
+        for i, line := range lines {
+            if len(line) > 76 || strings.ContainsAny(line, "\r\n") {
+                t.Errorf("invalid line. n=%d, line=%q", n, line)
+            }
+            if i < len(lines) - 1 && len(line) != 76 {
+                t.Errorf("line is not folded at 76 characters. n=%d, line=%q", n, line)
+            }
+        }
+        if wantLines := (n + 56) / 57; n > 0 && len(lines) != wantLines {
+            t.Errorf("lines=%d, want %d. n=%d", len(lines), wantLines, n)
+        }
+        decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+        if err != nil || !bytes.Equal(decoded, data) {
+            t.Errorf("decoded data does not match. n=%d, err=%v", n, err)
+        }
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Read the attachment, which is the last part of multipart/mixed, and
+// decode it with its Content-Transfer-Encoding.
+//////////////////////////////////////////////////////////////////////
+func readTestAttachment(t *testing.T, params *Params) (textproto.MIMEHeader, []byte) {
+    t.Helper()
+    msg := readTestMessage(t, params)
+    _, ps, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+    if err != nil {
+        t.Fatalf("mime.ParseMediaType() error. err=%v", err)
+    }
+    mr := multipart.NewReader(msg.Body, ps["boundary"])
+    var header textproto.MIMEHeader
+    var raw []byte
+    for {
+        // NextRawPart keeps Content-Transfer-Encoding, which NextPart removes for quoted-printable.
+        part, err := mr.NextRawPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            t.Fatalf("(*Reader) NextRawPart() error. err=%v", err)
+        }
+        header = part.Header
+        raw, _ = io.ReadAll(part)
+    }
+    var data []byte
+    switch header.Get("Content-Transfer-Encoding") {
+    case TRANSFER_ENCODING_BASE64:
+        data, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(raw), "\r\n", ""))
+    case TRANSFER_ENCODING_QUOTED_PRINTABLE:
+        data, err = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+    default:
+        data = raw
+    }
+    if err != nil {
+        t.Fatalf("decode error. err=%v", err)
+    }
+    return header, data
+}
+
+
+func TestAttachmentTransferEncoding(t *testing.T) {
+    csv := []byte("name,price\r\ncafé,100\r\n")
+    log := []byte("line 1\r\nline 2")
+    bin := []byte{0x00, 0x01, 0xfe, 0xff}
+    tests := []struct {
+        name string
+        attachment *Attachment
+        want string
+    }{
+        {"csv", GenAttachment("prices.csv", "text/csv", csv), TRANSFER_ENCODING_QUOTED_PRINTABLE},
+        {"text", GenAttachment("a.log", CONTENT_TYPE_TEXT_PLAIN, log), TRANSFER_ENCODING_QUOTED_PRINTABLE},
+        {"text 7bit", &Attachment{FileName: "a.log", ContentType: CONTENT_TYPE_TEXT_PLAIN, Data: log, TransferEncoding: TRANSFER_ENCODING_7BIT}, TRANSFER_ENCODING_7BIT},
+        {"text base64", &Attachment{FileName: "a.log", ContentType: CONTENT_TYPE_TEXT_PLAIN, Data: log, TransferEncoding: TRANSFER_ENCODING_BASE64}, TRANSFER_ENCODING_BASE64},
+        {"binary", GenAttachment("a.bin", CONTENT_TYPE_APPLICATION_OCTET_STREAM, bin), TRANSFER_ENCODING_BASE64},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+            params.Attachments = []*Attachment{tt.attachment}
+            header, data := readTestAttachment(t, params)
+            if got := header.Get("Content-Transfer-Encoding"); got != tt.want {
+                t.Errorf("Content-Transfer-Encoding=%q, want %q", got, tt.want)
+            }
+            if !bytes.Equal(data, tt.attachment.Data) {
+                t.Errorf("data=%q, want %q", data, tt.attachment.Data)
+            }
+        })
+    }
+}
+
+
+func TestCRLFLineEndings(t *testing.T) {
+    bareLF := "line 1\nline 2\r\nline 3\n"
+    params := genTestParams(
+        &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: bareLF},
+        &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_UTF8, Data: "<p>café</p>\n<p>" + strings.Repeat("é", 100) + "</p>\n", AutoEncode: true},
+    )
+    params.Attachments = []*Attachment{
+        GenAttachment("a.csv", "text/csv", []byte("a,b\nc,é\n")),
+        {FileName: "a.log", ContentType: CONTENT_TYPE_TEXT_PLAIN, Data: []byte(bareLF), TransferEncoding: TRANSFER_ENCODING_7BIT},
+        GenAttachment("a.bin", CONTENT_TYPE_APPLICATION_OCTET_STREAM, []byte(strings.Repeat("\n\x00\r", 100))),
+    }
+    b, err := BuildMessage(params)
+    if err != nil {
+        t.Fatalf("BuildMessage() error. err=%v", err)
+    }
+    for i, c := range b {
+        if c == '\n' && (i == 0 || b[i - 1] != '\r') {
+            t.Fatalf("bare LF. offset=%d, around=%q", i, b[max(0, i - 20):i + 1])
+        }
+        if c == '\r' && (i == len(b) - 1 || b[i + 1] != '\n') {
+            t.Fatalf("bare CR. offset=%d, around=%q", i, b[max(0, i - 20):min(len(b), i + 20)])
+        }
+    }
+    if !bytes.HasSuffix(b, []byte("\r\n")) {
+        t.Errorf("the message does not end with CRLF. message=%q", b)
+    }
+}
+
+
+func TestOrganizationHeader(t *testing.T) {
+    tests := []struct {
+        name string
+        organization string
+    }{
+        {"ascii", "Example Inc."},
+        {"latin", "Café Example"},
+        {"japanese", "株式会社ノウノウ"},
+        {"long japanese", strings.Repeat("株式会社ノウノウ情報システム部", 4)},
+    }
+    dec := new(mime.WordDecoder)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+            params.Header.Organization = tt.organization
+            msg := readTestMessage(t, params)
+            raw := msg.Header.Get("Organization")
+            for i := 0; i < len(raw); i++ {
+                if raw[i] >= 0x80 {
+                    t.Fatalf("Organization has non-ASCII. raw=%q", raw)
+                }
+            }
+            got, err := dec.DecodeHeader(raw)
+            if err != nil {
+                t.Fatalf("(*WordDecoder) DecodeHeader() error. err=%v", err)
+            }
+            if got != tt.organization {
+                t.Errorf("decoded Organization=%q, want %q. raw=%q", got, tt.organization, raw)
+            }
+        })
+    }
+}
+
+
+func TestCommentsKeywordsHeaders(t *testing.T) {
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.Header.Comments = "会議のメモ"
+    params.Header.Keywords = []string{"会議", "meeting", "Café"}
+    msg := readTestMessage(t, params)
+    dec := new(mime.WordDecoder)
+    raw := msg.Header.Get("Comments")
+    if got, err := dec.DecodeHeader(raw); err != nil || got != params.Header.Comments {
+        t.Errorf("decoded Comments=%q, %v, want %q. raw=%q", got, err, params.Header.Comments, raw)
+    }
+    raw = msg.Header.Get("Keywords")
+    keywords := strings.Split(raw, ", ")
+    if len(keywords) != len(params.Header.Keywords) {
+        t.Fatalf("Keywords=%q, want %d keywords", raw, len(params.Header.Keywords))
+    }
+    for i, keyword := range keywords {
+        if got, err := dec.DecodeHeader(keyword); err != nil || got != params.Header.Keywords[i] {
+            t.Errorf("decoded keyword=%q, %v, want %q", got, err, params.Header.Keywords[i])
+        }
+    }
+    if keywords[1] != "meeting" {
+        t.Errorf("ASCII keyword is encoded. keyword=%q", keywords[1])
+    }
+    // The encoded headers do not require SMTPUTF8.
+    composed, err := composeMessage(params)
+    if err != nil {
+        t.Fatalf("composeMessage() error. err=%v", err)
+    }
+    if needsSmtpUtf8(params, composed.header) {
+        t.Errorf("SMTPUTF8 is required. header=%q", composed.header)
+    }
+}
+
+
+func TestMimeVersionHeader(t *testing.T) {
+    text := &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"}
+    html := &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_US_ASCII, Data: "<p>hello</p>"}
+    tests := []struct {
+        name string
+        bodies []*Body
+        attachments []*Attachment
+        want bool
+    }{
+        {"us-ascii 7bit text", []*Body{text}, nil, false},
+        {"utf-8 7bit text", []*Body{{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "hello"}}, nil, true},
+        {"iso-2022-jp text", []*Body{{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_ISO_2022_JP, Data: "hello"}}, nil, true},
+        {"8bit text", []*Body{{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "café"}}, nil, true},
+        {"html", []*Body{html}, nil, true},
+        {"alternative", []*Body{text, html}, nil, true},
+        {"attachment", []*Body{text}, []*Attachment{GenAttachment("a.bin", CONTENT_TYPE_APPLICATION_OCTET_STREAM, []byte{0})}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(tt.bodies...)
+            params.Attachments = tt.attachments
+            header, _ := splitTestMessage(t, params)
+            // The spelling is pinned, since some filters match it case-sensitively.
+            got := strings.Contains("\r\n" + header, "\r\nMIME-Version: 1.0\r\n")
+            if got != tt.want {
+                t.Errorf("MIME-Version: 1.0 written=%v, want %v. header=%q", got, tt.want, header)
+            }
+            if strings.Contains(strings.ToLower(header), "mime-version") != tt.want {
+                t.Errorf("MIME-Version is written in another spelling. header=%q", header)
+            }
+        })
+    }
+}
+
+
+func TestHeaderBodySeparator(t *testing.T) {
+    text := &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"}
+    html := &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_US_ASCII, Data: "<p>hello</p>"}
+    tests := []struct {
+        name string
+        bodies []*Body
+        attachments []*Attachment
+        wantPrefix string
+    }{
+        {"single", []*Body{text}, nil, "hello"},
+        {"single with a leading blank line", []*Body{{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "\r\nhello"}}, nil, "\r\nhello"},
+        {"alternative", []*Body{text, html}, nil, "--"},
+        {"mixed", []*Body{text}, []*Attachment{GenAttachment("a.bin", CONTENT_TYPE_APPLICATION_OCTET_STREAM, []byte{0})}, "--"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(tt.bodies...)
+            params.Attachments = tt.attachments
+            b, err := BuildMessage(params)
+            if err != nil {
+                t.Fatalf("BuildMessage() error. err=%v", err)
+            }
+            header, content, ok := strings.Cut(string(b), "\r\n\r\n")
+            if !ok {
+                t.Fatalf("no blank line after the headers. message=%q", b)
+            }
+            // Every header line is a field or its continuation.
+            for _, line := range strings.Split(header, "\r\n") {
+                if line == "" || (line[0] != ' ' && line[0] != '\t' && !strings.Contains(line, ":")) {
+                    t.Errorf("invalid header line. line=%q", line)
+                }
+            }
+            if !strings.HasPrefix(content, tt.wantPrefix) {
+                t.Errorf("content does not start with %q. content=%q", tt.wantPrefix, content)
+            }
+            msg, err := mail.ReadMessage(bytes.NewReader(b))
+            if err != nil {
+                t.Fatalf("mail.ReadMessage() error. err=%v", err)
+            }
+            body, _ := io.ReadAll(msg.Body)
+            if string(body) != content {
+                t.Errorf("body=%q, want %q", body, content)
+            }
+        })
+    }
+}
+
+
+func TestSinglePartRoundTrip(t *testing.T) {
+    tests := []struct {
+        name string
+        body *Body
+        // The message ends with CRLF, which is added unless the body has.
+        want string
+        wantEncoding string
+    }{
+        {"7bit", &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello\r\nworld"}, "hello\r\nworld\r\n", TRANSFER_ENCODING_7BIT},
+        {"8bit", &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "こんにちは\r\n世界"}, "こんにちは\r\n世界\r\n", TRANSFER_ENCODING_8BIT},
+        {"trailing line break", &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello\r\n"}, "hello\r\n", TRANSFER_ENCODING_7BIT},
+        {"leading blank line", &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "\r\nhello"}, "\r\nhello\r\n", TRANSFER_ENCODING_7BIT},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            msg := readTestMessage(t, genTestParams(tt.body))
+            got, err := io.ReadAll(msg.Body)
+            if err != nil {
+                t.Fatalf("io.ReadAll() error. err=%v", err)
+            }
+            if string(got) != tt.want {
+                t.Errorf("body=%q, want %q", got, tt.want)
+            }
+            if encoding := msg.Header.Get("Content-Transfer-Encoding"); encoding != tt.wantEncoding {
+                t.Errorf("Content-Transfer-Encoding=%q, want %q", encoding, tt.wantEncoding)
+            }
+        })
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Walk the MIME tree, and return the leaf parts in depth-first order as
+// the content types and the decoded contents.
+//////////////////////////////////////////////////////////////////////
+func readTestLeaves(t *testing.T, header textproto.MIMEHeader, body io.Reader) [][2]string {
+    t.Helper()
+    mediaType, ps, err := mime.ParseMediaType(header.Get("Content-Type"))
+    if err != nil {
+        t.Fatalf("mime.ParseMediaType() error. contentType=%q, err=%v", header.Get("Content-Type"), err)
+    }
+    if !strings.HasPrefix(mediaType, "multipart/") {
+        data, err := io.ReadAll(body)
+        if err != nil {
+            t.Fatalf("io.ReadAll() error. err=%v", err)
+        }
+        // NextPart decodes quoted-printable, but not base64.
+        if header.Get("Content-Transfer-Encoding") == TRANSFER_ENCODING_BASE64 {
+            if data, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(data), "\r\n", "")); err != nil {
+                t.Fatalf("base64 decode error. err=%v", err)
+            }
+        }
+        return [][2]string{{mediaType, string(data)}}
+    }
+    leaves := make([][2]string, 0)
+    mr := multipart.NewReader(body, ps["boundary"])
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            t.Fatalf("(*Reader) NextPart() error. err=%v", err)
+        }
+        leaves = append(leaves, readTestLeaves(t, part.Header, part)...)
+    }
+    return leaves
+}
+
+
+func TestMultipartRoundTrip(t *testing.T) {
+    text := &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "こんにちは\r\nworld"}
+    html := &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_UTF8, Data: "<p>café " + strings.Repeat("long line ", 20) + "</p><img src=\"cid:logo\">", AutoEncode: true}
+    image := GenInlineImage("logo", "logo.png", "image/png", []byte{0x89, 'P', 'N', 'G', 0x00, 0xff})
+    csv := GenAttachment("a.csv", "text/csv", []byte("name,price\r\ncafé,100\r\n"))
+    bin := GenAttachment("a.bin", CONTENT_TYPE_APPLICATION_OCTET_STREAM, []byte{0x00, 0x01, 0xfe, 0xff})
+    tests := []struct {
+        name string
+        bodies []*Body
+        images []*InlineImage
+        attachments []*Attachment
+        want [][2]string
+    }{
+        {"alternative", []*Body{text, html}, nil, nil, [][2]string{
+            {"text/plain", text.Data}, {"text/html", html.Data},
+        }},
+        {"related", []*Body{html}, []*InlineImage{image}, nil, [][2]string{
+            {"text/html", html.Data}, {"image/png", string(image.Data)},
+        }},
+        {"mixed", []*Body{text}, nil, []*Attachment{csv, bin}, [][2]string{
+            {"text/plain", text.Data}, {"text/csv", string(csv.Data)}, {"application/octet-stream", string(bin.Data)},
+        }},
+        {"all", []*Body{text, html}, []*InlineImage{image}, []*Attachment{csv, bin}, [][2]string{
+            {"text/plain", text.Data}, {"text/html", html.Data}, {"image/png", string(image.Data)},
+            {"text/csv", string(csv.Data)}, {"application/octet-stream", string(bin.Data)},
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(tt.bodies...)
+            params.InlineImages = tt.images
+            params.Attachments = tt.attachments
+            msg := readTestMessage(t, params)
+            got := readTestLeaves(t, textproto.MIMEHeader(msg.Header), msg.Body)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("parts=%q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+
+func TestPriorityHeaders(t *testing.T) {
+    tests := []struct {
+        priority string
+        want map[string]string
+    }{
+        {PRIORITY_HIGH, map[string]string{"Importance": "high", "X-Priority": "1 (Highest)", "X-Msmail-Priority": "High"}},
+        {PRIORITY_NORMAL, map[string]string{"Importance": "normal", "X-Priority": "3 (Normal)", "X-Msmail-Priority": "Normal"}},
+        {PRIORITY_LOW, map[string]string{"Importance": "low", "X-Priority": "5 (Lowest)", "X-Msmail-Priority": "Low"}},
+        {"", map[string]string{"Importance": "", "X-Priority": "", "X-Msmail-Priority": ""}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.priority, func(t *testing.T) {
+            params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+            params.Header.Priority = tt.priority
+            msg := readTestMessage(t, params)
+            for name, want := range tt.want {
+                if got := msg.Header.Get(name); got != want {
+                    t.Errorf("%s=%q, want %q", name, got, want)
+                }
+            }
+        })
+    }
+
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.Header.Priority = "urgent"
+    if b, err := BuildMessage(params); err == nil {
+        t.Errorf("BuildMessage() succeeded with an invalid priority. message=%q", b)
+    }
+}
+
+
+func TestSubjectEncoding(t *testing.T) {
+    subjects := []string{
+        "Hello",
+        "Café au lait",
+        "日本語の件名です",
+        "Mixed 日本語 and ASCII = ? _",
+        strings.Repeat("長い件名", 30),
+    }
+    encodings := []string{SUBJECT_ENCODING_AUTO, SUBJECT_ENCODING_B, SUBJECT_ENCODING_Q}
+    dec := new(mime.WordDecoder)
+    for _, subject := range subjects {
+        for _, encoding := range encodings {
+            t.Run(encoding + "/" + subject, func(t *testing.T) {
+                params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+                params.Header.Subject = subject
+                params.Header.SubjectEncoding = encoding
+                msg := readTestMessage(t, params)
+                raw := msg.Header.Get("Subject")
+                got, err := dec.DecodeHeader(raw)
+                if err != nil {
+                    t.Fatalf("(*WordDecoder) DecodeHeader() error. err=%v", err)
+                }
+                if got != subject {
+                    t.Errorf("decoded subject=%q, want %q. raw=%q", got, subject, raw)
+                }
+                for i := 0; i < len(raw); i++ {
+                    if raw[i] >= 0x80 {
+                        t.Fatalf("subject has non-ASCII. raw=%q", raw)
+                    }
+                }
+            })
+        }
+    }
+
+    // Q is chosen for a mostly ASCII subject, and B for a mostly non-ASCII one.
+    for subject, want := range map[string]string{"Café au lait": "=?UTF-8?q?", "日本語の件名です": "=?UTF-8?b?"} {
+        if got, err := encodeSubject(subject, SUBJECT_ENCODING_AUTO); err != nil || !strings.HasPrefix(got, want) {
+            t.Errorf("encodeSubject()=%q, %v, want prefix %q", got, err, want)
+        }
+    }
+    params := genTestParams()
+    params.Header.SubjectEncoding = "X"
+    if _, err := BuildMessage(params); err == nil {
+        t.Error("BuildMessage() succeeded with an invalid subject encoding")
+    }
+}
+
+
+func TestGzipAttachment(t *testing.T) {
+    data := []byte(strings.Repeat("time,level,message\r\n2019-01-01,INFO,hello\r\n", 100))
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.Attachments = []*Attachment{{FileName: "app.log", ContentType: CONTENT_TYPE_TEXT_PLAIN, Data: data, Gzip: true}}
+    header, compressed := readTestAttachment(t, params)
+    if mediaType, ps, _ := mime.ParseMediaType(header.Get("Content-Type")); mediaType != CONTENT_TYPE_APPLICATION_GZIP || ps["name"] != "app.log.gz" {
+        t.Errorf("unexpected Content-Type. contentType=%q", header.Get("Content-Type"))
+    }
+    if _, ps, _ := mime.ParseMediaType(header.Get("Content-Disposition")); ps["filename"] != "app.log.gz" {
+        t.Errorf("unexpected Content-Disposition. contentDisposition=%q", header.Get("Content-Disposition"))
+    }
+    if encoding := header.Get("Content-Transfer-Encoding"); encoding != TRANSFER_ENCODING_BASE64 {
+        t.Errorf("Content-Transfer-Encoding=%q, want %q", encoding, TRANSFER_ENCODING_BASE64)
+    }
+    if len(compressed) >= len(data) {
+        t.Errorf("data is not compressed. size=%d, compressed=%d", len(data), len(compressed))
+    }
+    zr, err := gzip.NewReader(bytes.NewReader(compressed))
+    if err != nil {
+        t.Fatalf("gzip.NewReader() error. err=%v", err)
+    }
+    got, err := io.ReadAll(zr)
+    if err != nil {
+        t.Fatalf("gzip read error. err=%v", err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Errorf("decompressed data does not match")
+    }
+    if zr.Name != "app.log" {
+        t.Errorf("gzip name=%q, want %q", zr.Name, "app.log")
+    }
+}
+
+
+func TestHeaderOrder(t *testing.T) {
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "こんにちは"})
+    params.Header.Cc = []string{"cc@example.com"}
+    params.Header.Bcc = []string{"bcc@example.com"}
+    params.Header.ReplyTo = "reply@example.com"
+    params.Header.Organization = "Example"
+    params.Header.Priority = PRIORITY_HIGH
+    params.Header.ExtraHeaders = []*HeaderField{{Name: "X-Trace", Value: "1"}, {Name: "X-Campaign", Value: "2"}}
+    want := []string{
+        "From", "To", "Cc", "Subject", "Date", "Message-ID", "MIME-Version", "Reply-To", "Organization",
+        "Importance", "X-Priority", "X-MSMail-Priority", "X-Trace", "X-Campaign",
+        "Content-Type", "Content-Transfer-Encoding",
+    }
+    // The order is the same on every composition.
+    for i := 0; i < 10; i++ {
+        header, _ := splitTestMessage(t, params)
+        if got := testHeaderNames(header); !reflect.DeepEqual(got, want) {
+            t.Fatalf("header names=%q, want %q", got, want)
+        }
+    }
+}
+
+
+func TestDateMessageID(t *testing.T) {
+    params := genTestParams()
+    msg := readTestMessage(t, params)
+    if _, err := msg.Header.Date(); err != nil {
+        t.Errorf("invalid generated Date. date=%q, err=%v", msg.Header.Get("Date"), err)
+    }
+    if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+        t.Errorf("invalid generated Message-ID. messageID=%q", id)
+    }
+
+    date := time.Date(2019, 4, 1, 9, 30, 0, 0, time.UTC)
+    params.Header.Date = date
+    params.Header.MessageID = "abc@example.com"
+    msg = readTestMessage(t, params)
+    if got, err := msg.Header.Date(); err != nil || !got.Equal(date) {
+        t.Errorf("Date=%v, %v, want %v", got, err, date)
+    }
+    if got := msg.Header.Get("Message-ID"); got != "<abc@example.com>" {
+        t.Errorf("Message-ID=%q, want %q", got, "<abc@example.com>")
+    }
+
+    for _, name := range []string{"Date", "Message-ID", "message-id"} {
+        params := genTestParams()
+        params.Header.ExtraHeaders = []*HeaderField{{Name: name, Value: "x"}}
+        if _, err := BuildMessage(params); err == nil {
+            t.Errorf("BuildMessage() succeeded with the extra header %q", name)
+        }
+    }
+}
+
+
+func TestAddressFolding(t *testing.T) {
+    japaneseName := strings.Repeat("株式会社サンプル営業部", 4)
+    to := []string{
+        `"Doe, John (Sales Department, Tokyo Office, Second Floor, Building A)" <john.doe@example.com>`,
+        "Alexander Bartholomew Christopherson Montgomery of the Northern Regional Office <alex@example.com>",
+        mime.BEncoding.Encode(CHARSET_UTF8, japaneseName) + " <sales@example.jp>",
+        `"Smith,   Jane" <jane.smith@example.com>`,
+        "very.long.local.part.of.an.address.exceeding.the.line.limit.of.seventy.eight@example.com",
+        "last@example.com",
+    }
+    for _, addr := range to[:3] {
+        if len(addr) <= 78 {
+            t.Fatalf("test address is not longer than 78 characters. addr=%q", addr)
+        }
+    }
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.Header.To = strings.Join(to, ", ")
+    params.Header.Cc = to
+    header, _ := splitTestMessage(t, params)
+    for _, line := range strings.Split(header, "\r\n") {
+        if len(line) <= 78 {
+            continue
+        }
+        // Only a single word which has no whitespace to fold at may exceed the limit.
+        word := strings.TrimLeft(line, " \t")
+        if i := strings.Index(line, ": "); i >= 0 && line[0] != ' ' && line[0] != '\t' {
+            word = line[i + 2:]
+        }
+        if strings.ContainsAny(word, " \t") {
+            t.Errorf("line is longer than 78 characters. line=%q", line)
+        }
+    }
+    want, err := mail.ParseAddressList(params.Header.To)
+    if err != nil {
+        t.Fatalf("mail.ParseAddressList() error. err=%v", err)
+    }
+    msg := readTestMessage(t, params)
+    for _, name := range []string{"To", "Cc"} {
+        got, err := msg.Header.AddressList(name)
+        if err != nil {
+            t.Fatalf("(Header) AddressList() error. name=%s, err=%v", name, err)
+        }
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("%s=%v, want %v", name, got, want)
+        }
+        if got[2].Name != japaneseName {
+            t.Errorf("decoded name=%q, want %q", got[2].Name, japaneseName)
+        }
+    }
+}
+
+
+func TestAutoResponseSuppressHeader(t *testing.T) {
+    for _, value := range []string{AUTO_RESPONSE_SUPPRESS_ALL, AUTO_RESPONSE_SUPPRESS_OOF + ", " + AUTO_RESPONSE_SUPPRESS_DR + ", " + AUTO_RESPONSE_SUPPRESS_NDR} {
+        params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+        params.Header.AutoResponseSuppress = value
+        msg := readTestMessage(t, params)
+        if got := msg.Header.Get("X-Auto-Response-Suppress"); got != value {
+            t.Errorf("X-Auto-Response-Suppress=%q, want %q", got, value)
+        }
+    }
+
+    for _, value := range []string{"All, ", "Out of office", "All\r\nBcc: x@example.com"} {
+        params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+        params.Header.AutoResponseSuppress = value
+        if b, err := BuildMessage(params); err == nil {
+            t.Errorf("BuildMessage() succeeded with an invalid auto response suppress. value=%q, message=%q", value, b)
+        }
+    }
+}
+
+
+func TestExpiryDateHeader(t *testing.T) {
+    expiry := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.Header.ExpiryDate = expiry
+    msg := readTestMessage(t, params)
+    got, err := mail.ParseDate(msg.Header.Get("Expiry-Date"))
+    if err != nil {
+        t.Fatalf("mail.ParseDate() error. err=%v", err)
+    }
+    if !got.Equal(expiry) {
+        t.Errorf("Expiry-Date=%v, want %v", got, expiry)
+    }
+
+    params.Header.ExpiryDate = time.Now().Add(-time.Minute)
+    if b, err := BuildMessage(params); err == nil {
+        t.Errorf("BuildMessage() succeeded with a past expiry date. message=%q", b)
+    }
+}
+
+
+func walkTestParts(t *testing.T, header textproto.MIMEHeader, body io.Reader) []string {
+    t.Helper()
+    mediaType, ps, err := mime.ParseMediaType(header.Get("Content-Type"))
+    if err != nil {
+        t.Fatalf("mime.ParseMediaType() error. contentType=%q, err=%v", header.Get("Content-Type"), err)
+    }
+    types := []string{mediaType}
+    if !strings.HasPrefix(mediaType, "multipart/") {
+        if header.Get("Content-Transfer-Encoding") == "" {
+            t.Errorf("leaf part has no Content-Transfer-Encoding. contentType=%q", mediaType)
+        }
+        return types
+    }
+    if header.Get("Content-Transfer-Encoding") != "" {
+        t.Errorf("multipart has Content-Transfer-Encoding. contentType=%q", mediaType)
+    }
+    mr := multipart.NewReader(body, ps["boundary"])
+    for {
+        // NextRawPart keeps Content-Transfer-Encoding, which NextPart removes for quoted-printable.
+        part, err := mr.NextRawPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            t.Fatalf("(*Reader) NextRawPart() error. err=%v", err)
+        }
+        types = append(types, walkTestParts(t, part.Header, part)...)
+    }
+    return append(types, "/" + mediaType)
+}
+
+
+func TestMultipartStructure(t *testing.T) {
+    text := &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "héllo", AutoEncode: true}
+    html := &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_UTF8, Data: "<p>hello</p><img src=\"cid:logo\">"}
+    image := GenInlineImage("logo", "logo.png", "image/png", []byte{0x89, 'P', 'N', 'G'})
+    attachment := GenAttachment("a.txt", CONTENT_TYPE_TEXT_PLAIN, []byte("attached"))
+    tests := []struct {
+        name string
+        bodies []*Body
+        images []*InlineImage
+        attachments []*Attachment
+        want []string
+    }{
+        {"single", []*Body{text}, nil, nil, []string{"text/plain"}},
+        {"alternative", []*Body{text, html}, nil, nil, []string{
+            "multipart/alternative", "text/plain", "text/html", "/multipart/alternative",
+        }},
+        {"related", []*Body{html}, []*InlineImage{image}, nil, []string{
+            "multipart/related", "text/html", "image/png", "/multipart/related",
+        }},
+        {"mixed", []*Body{text}, nil, []*Attachment{attachment}, []string{
+            "multipart/mixed", "text/plain", "text/plain", "/multipart/mixed",
+        }},
+        {"all", []*Body{text, html}, []*InlineImage{image}, []*Attachment{attachment}, []string{
+            "multipart/mixed",
+            "multipart/related", "multipart/alternative", "text/plain", "text/html", "/multipart/alternative", "image/png", "/multipart/related",
+            "text/plain",
+            "/multipart/mixed",
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(tt.bodies...)
+            params.InlineImages = tt.images
+            params.Attachments = tt.attachments
+            msg := readTestMessage(t, params)
+            got := walkTestParts(t, textproto.MIMEHeader(msg.Header), msg.Body)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("parts=%q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+
+func TestHeadersOnlyMessage(t *testing.T) {
+    params := genTestParams()
+    if err := params.Validate(); err != nil {
+        t.Fatalf("Validate() error. err=%v", err)
+    }
+    // The blank line separating the headers from the empty body is required.
+    if _, body := splitTestMessage(t, params); body != "" {
+        t.Errorf("body=%q, want empty", body)
+    }
+    msg := readTestMessage(t, params)
+    mediaType, ps, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+    if err != nil || mediaType != CONTENT_TYPE_TEXT_PLAIN || ps["charset"] != CHARSET_UTF8 {
+        t.Errorf("unexpected Content-Type. contentType=%q, err=%v", msg.Header.Get("Content-Type"), err)
+    }
+}
+
+
+func TestGenBoundary(t *testing.T) {
+    seen := make(map[string]bool)
+    for i := 0; i < 1000; i++ {
+        b := genBoundary()
+        if len(b) != 32 || strings.Trim(b, "1234567890abcdefghijklmnopqrstuvwxyz") != "" {
+            t.Fatalf("invalid boundary. boundary=%q", b)
+        }
+        if seen[b] {
+            t.Fatalf("duplicate boundary. boundary=%q", b)
+        }
+        seen[b] = true
+    }
+}
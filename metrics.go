@@ -0,0 +1,38 @@
+//////////////////////////////////////////////////////////////////////
+// metrics.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     type myMetrics struct{}
+//
+//     func (m *myMetrics) ConnectDuration(d time.Duration) { connectHistogram.Observe(d.Seconds()) }
+//     func (m *myMetrics) AuthDuration(d time.Duration) { authHistogram.Observe(d.Seconds()) }
+//     func (m *myMetrics) DataDuration(d time.Duration) { dataHistogram.Observe(d.Seconds()) }
+//     func (m *myMetrics) SendDuration(d time.Duration) { sendHistogram.Observe(d.Seconds()) }
+//
+//     params.Metrics = &myMetrics{}
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "time"
+)
+
+// Receiver of the durations of the phases of sending.
+// Each method is called when the phase succeeds.
+type Metrics interface {
+    // Connecting, including the greeting and STARTTLS.
+    ConnectDuration(d time.Duration)
+    // Authentication.
+    AuthDuration(d time.Duration)
+    // Mail transaction, from MAIL FROM to the end of DATA.
+    DataDuration(d time.Duration)
+    // The whole sending.
+    SendDuration(d time.Duration)
+}
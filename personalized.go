@@ -0,0 +1,106 @@
+//////////////////////////////////////////////////////////////////////
+// personalized.go
+//
+// @usage
+//
+//     The bodies generated from templates (e.g. GenBodyFromFiles()) are
+//     rendered again with the parameters of each recipient. The other
+//     bodies are sent as they are.
+//     The bodies modified after rendering (e.g. by InlineCSS(), AppendFooter()
+//     or InjectPreheader()) can not be rendered again, so use Params.Footer
+//     and Params.Preheader instead, which are applied on each sending.
+//
+//     --------------------------------------------------
+//     recipients := []myMailer.PersonalizedRecipient{
+//         {Address: "foo@example.com", Params: map[string]string{"name": "Foo"}},
+//         {Address: "bar@example.com", Params: map[string]string{"name": "Bar"}},
+//     }
+//     for i, err := range myMailer.SendPersonalized(params, recipients) {
+//         if err != nil {
+//             // Error handling for recipients[i].
+//         }
+//     }
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+)
+
+type PersonalizedRecipient struct {
+    Address string
+    Params map[string]string
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send the message to each recipient separately, with the bodies
+// rendered with the recipient's parameters.
+// The To of the base header is replaced with the recipient, and Cc and
+// Bcc are not used. The errors are in the same order as the recipients,
+// and nil for the succeeded ones.
+//////////////////////////////////////////////////////////////////////
+func SendPersonalized(base *Params, recipients []PersonalizedRecipient) []error {
+    errs := make([]error, len(recipients))
+    for i, r := range recipients {
+        bodies, err := renderBodies(base.Body, r.Params)
+        if err != nil {
+            errs[i] = err
+            continue
+        }
+        header := *base.Header
+        header.To = r.Address
+        header.ToGroups = nil
+        header.Cc = nil
+        header.CcGroups = nil
+        header.Bcc = nil
+        params := *base
+        params.Header = &header
+        params.Body = bodies
+        errs[i] = Send(&params)
+    }
+    return errs
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Render the bodies generated from templates with the parameters.
+// A body modified after rendering is an error with the parameters, since
+// it would be sent without them.
+//////////////////////////////////////////////////////////////////////
+func renderBodies(bodies []*Body, params map[string]string) ([]*Body, error) {
+    rendered := make([]*Body, 0, len(bodies))
+    renderedOf := make(map[*Body]*Body)
+    for _, b := range bodies {
+        if b.modified && len(params) > 0 {
+            return nil, errors.New("body modified after rendering the template can not be rendered with the recipient params. contentType=" + b.ContentType)
+        }
+        if b.tmpl == nil {
+            rendered = append(rendered, b)
+            continue
+        }
+        data, err := executeTemplate(b.tmpl, b.tmplName, params)
+        if err != nil {
+            return nil, err
+        }
+        nb := *b
+        nb.Data = data
+        rendered = append(rendered, &nb)
+        renderedOf[b] = &nb
+    }
+    // Convert the text bodies again from the rendered HTML bodies.
+    for i, b := range rendered {
+        if src, ok := renderedOf[b.textOf]; ok {
+            nb := *b
+            nb.Data = HtmlToText(src.Data)
+            nb.textOf = src
+            rendered[i] = &nb
+        }
+    }
+    return rendered, nil
+}
@@ -0,0 +1,63 @@
+//////////////////////////////////////////////////////////////////////
+// personalized_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "testing"
+)
+
+
+func TestRenderBodies(t *testing.T) {
+    body, err := GenBodyFromString(CONTENT_TYPE_TEXT_HTML, CHARSET_UTF8, "<html><head><style>p { color: red; }</style></head><body><p>Hello {{ .name }}</p></body></html>", map[string]string{"name": "Base"})
+    if err != nil {
+        t.Fatalf("GenBodyFromString() error. err=%v", err)
+    }
+    rendered, err := renderBodies([]*Body{body}, map[string]string{"name": "Foo"})
+    if err != nil || rendered[0].Data != "<html><head><style>p { color: red; }</style></head><body><p>Hello Foo</p></body></html>" {
+        t.Errorf("renderBodies()=%q, %v", rendered[0].Data, err)
+    }
+
+    inlined, err := InlineCSS(body)
+    if err != nil {
+        t.Fatalf("InlineCSS() error. err=%v", err)
+    }
+    preheader, err := InjectPreheader(body, "preview")
+    if err != nil {
+        t.Fatalf("InjectPreheader() error. err=%v", err)
+    }
+    tests := []struct {
+        name string
+        body *Body
+    }{
+        {"InlineCSS", inlined},
+        {"AppendFooter", AppendFooter(body, "footer")},
+        {"InjectPreheader", preheader},
+        {"AppendFooter after InlineCSS", AppendFooter(inlined, "footer")},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := renderBodies([]*Body{tt.body}, map[string]string{"name": "Foo"}); err == nil {
+                t.Error("renderBodies() succeeded for a body modified after rendering")
+            }
+            // Without the params, the body is sent as it is.
+            if rendered, err := renderBodies([]*Body{tt.body}, nil); err != nil || rendered[0] != tt.body {
+                t.Errorf("renderBodies() without params error. err=%v", err)
+            }
+            errs := SendPersonalized(genTestParams(tt.body), []PersonalizedRecipient{{Address: "foo@example.com", Params: map[string]string{"name": "Foo"}}})
+            if errs[0] == nil {
+                t.Error("SendPersonalized() succeeded for a body modified after rendering")
+            }
+        })
+    }
+
+    // A body not rendered from a template is sent as it is.
+    plain := AppendFooter(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "hello"}, "footer")
+    if rendered, err := renderBodies([]*Body{plain}, map[string]string{"name": "Foo"}); err != nil || rendered[0] != plain {
+        t.Errorf("renderBodies() error for a body without a template. err=%v", err)
+    }
+}
@@ -0,0 +1,95 @@
+//////////////////////////////////////////////////////////////////////
+// pgp.go
+//
+// @usage
+//
+//     The encryption itself is delegated to the caller, so that this package
+//     does not depend on any OpenPGP implementation.
+//     The content (bodies and attachments) is encrypted and composed as
+//     multipart/encrypted according to RFC3156.
+//
+//     --------------------------------------------------
+//     params.PgpConfig = myMailer.GenPgpConfig(recipientPublicKey, func(plaintext []byte, publicKey []byte) ([]byte, error) {
+//         // Encrypt the plaintext with the public key, and return it ASCII-armored.
+//     })
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "bytes"
+    "errors"
+)
+
+const pgpMessageArmorHeader = "-----BEGIN PGP MESSAGE-----"
+
+// This package does not implement OpenPGP. Encrypt must be given by the
+// caller with an OpenPGP implementation (e.g. github.com/ProtonMail/go-crypto/openpgp),
+// and only the format of its output is checked.
+type PgpConfig struct {
+    // Encrypt the plaintext with the public key, and return it ASCII-armored.
+    Encrypt func(plaintext []byte, publicKey []byte) ([]byte, error)
+    PublicKey []byte
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate PgpConfig Struct
+//////////////////////////////////////////////////////////////////////
+func GenPgpConfig(publicKey []byte, encrypt func(plaintext []byte, publicKey []byte) ([]byte, error)) *PgpConfig {
+    return &PgpConfig{
+        Encrypt: encrypt,
+        PublicKey: publicKey,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Write the encrypted content as multipart/encrypted.
+// The output of Encrypt must be an ASCII-armored PGP message, so that
+// the content is never sent in cleartext labelled as encrypted.
+//////////////////////////////////////////////////////////////////////
+func writePgpEncrypted(mw *messageWriter, pgpConfig *PgpConfig, params *Params) error {
+    if pgpConfig.Encrypt == nil {
+        return errors.New("PgpConfig.Encrypt is nil")
+    }
+    // The content is encrypted only once, even if the message is written
+    // again after counting its size.
+    encrypted := mw.msg.encrypted
+    if encrypted == nil {
+        content := new(bytes.Buffer)
+        cmw := &messageWriter{boundaryGenerator: mw.boundaryGenerator, w: content}
+        writeContent(cmw, params)
+        // A partly composed content must not be encrypted and sent.
+        if cmw.err != nil {
+            return cmw.err
+        }
+        var err error
+        if encrypted, err = pgpConfig.Encrypt(content.Bytes(), pgpConfig.PublicKey); err != nil {
+            return errors.New("(*PgpConfig) Encrypt() error. err=" + err.Error())
+        }
+        if !bytes.HasPrefix(bytes.TrimLeft(encrypted, " \t\r\n"), []byte(pgpMessageArmorHeader)) || DetectTransferEncoding(encrypted) != TRANSFER_ENCODING_7BIT {
+            return errors.New("(*PgpConfig) Encrypt() did not return an ASCII-armored PGP message")
+        }
+        mw.msg.encrypted = encrypted
+    }
+    boundary := mw.boundary()
+    mw.writeString("Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"" + boundary + "\"\r\n\r\n")
+    mw.writeString("--" + boundary + "\r\n")
+    mw.writeString("Content-Type: application/pgp-encrypted\r\n")
+    mw.writeString("Content-Description: PGP/MIME version identification\r\n")
+    mw.writeString("Content-Transfer-Encoding: 7bit\r\n\r\n")
+    mw.writeString("Version: 1\r\n")
+    mw.writeString("--" + boundary + "\r\n")
+    mw.writeString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+    mw.writeString("Content-Description: OpenPGP encrypted message\r\n")
+    mw.writeString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n")
+    mw.writeString("Content-Transfer-Encoding: 7bit\r\n\r\n")
+    writeEncoded(mw, TRANSFER_ENCODING_7BIT, encrypted)
+    mw.writeString("\r\n--" + boundary + "--\r\n")
+    return nil
+}
@@ -0,0 +1,163 @@
+//////////////////////////////////////////////////////////////////////
+// pgp_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "bytes"
+    "encoding/base64"
+    "io"
+    "mime"
+    "mime/multipart"
+    "net/mail"
+    "strings"
+    "testing"
+)
+
+// The encryption is delegated to PgpConfig.Encrypt given by the caller,
+// e.g. with an OpenPGP library, so a stand-in cipher is used to check the
+// structure of the message and that the content is recovered.
+const (
+    testPgpArmorFooter = "-----END PGP MESSAGE-----"
+    testPgpArmorHeader = "-----BEGIN PGP MESSAGE-----"
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Stand-in for the OpenPGP encryption given by the caller.
+// The plaintext is XORed with the key and armored.
+//////////////////////////////////////////////////////////////////////
+func testPgpEncrypt(plaintext []byte, publicKey []byte) ([]byte, error) {
+    return []byte(testPgpArmorHeader + "\n\n" + base64.StdEncoding.EncodeToString(testXor(plaintext, publicKey)) + "\n" + testPgpArmorFooter + "\n"), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Reverse testPgpEncrypt.
+//////////////////////////////////////////////////////////////////////
+func testPgpDecrypt(armored []byte, key []byte) ([]byte, error) {
+    s := strings.TrimSpace(string(armored))
+    s = strings.TrimPrefix(s, testPgpArmorHeader)
+    s = strings.TrimSuffix(s, testPgpArmorFooter)
+    data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+    if err != nil {
+        return nil, err
+    }
+    return testXor(data, key), nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// XOR the data with the key.
+//////////////////////////////////////////////////////////////////////
+func testXor(data []byte, key []byte) []byte {
+    result := make([]byte, len(data))
+    for i := range data {
+        result[i] = data[i] ^ key[i % len(key)]
+    }
+    return result
+}
+
+
+func TestPgpRoundTrip(t *testing.T) {
+    key := []byte("test key")
+    params := genTestParams(
+        &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "secret text"},
+        &Body{ContentType: CONTENT_TYPE_TEXT_HTML, Charset: CHARSET_UTF8, Data: "<p>secret html</p>"},
+    )
+    params.PgpConfig = GenPgpConfig(key, testPgpEncrypt)
+    b, err := BuildMessage(params)
+    if err != nil {
+        t.Fatalf("BuildMessage() error. err=%v", err)
+    }
+    if bytes.Contains(b, []byte("secret")) {
+        t.Fatalf("cleartext is in the message. message=%q", b)
+    }
+    msg, err := mail.ReadMessage(bytes.NewReader(b))
+    if err != nil {
+        t.Fatalf("mail.ReadMessage() error. err=%v", err)
+    }
+    mediaType, ps, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+    if err != nil || mediaType != "multipart/encrypted" || ps["protocol"] != "application/pgp-encrypted" {
+        t.Fatalf("unexpected Content-Type. contentType=%q", msg.Header.Get("Content-Type"))
+    }
+    mr := multipart.NewReader(msg.Body, ps["boundary"])
+    if _, err = mr.NextPart(); err != nil {
+        t.Fatalf("version part error. err=%v", err)
+    }
+    part, err := mr.NextPart()
+    if err != nil {
+        t.Fatalf("encrypted part error. err=%v", err)
+    }
+    armored, _ := io.ReadAll(part)
+    plaintext, err := testPgpDecrypt(armored, key)
+    if err != nil {
+        t.Fatalf("decrypt error. err=%v", err)
+    }
+
+    // The decrypted content is the MIME entity of the bodies.
+    entity, err := mail.ReadMessage(bytes.NewReader(plaintext))
+    if err != nil {
+        t.Fatalf("mail.ReadMessage() error for the decrypted content. err=%v", err)
+    }
+    mediaType, ps, _ = mime.ParseMediaType(entity.Header.Get("Content-Type"))
+    if mediaType != "multipart/alternative" {
+        t.Fatalf("unexpected decrypted Content-Type. contentType=%q", entity.Header.Get("Content-Type"))
+    }
+    mr = multipart.NewReader(entity.Body, ps["boundary"])
+    for _, want := range []string{"secret text", "<p>secret html</p>"} {
+        part, err := mr.NextPart()
+        if err != nil {
+            t.Fatalf("decrypted part error. err=%v", err)
+        }
+        got, _ := io.ReadAll(part)
+        if string(got) != want {
+            t.Errorf("decrypted body=%q, want %q", got, want)
+        }
+    }
+}
+
+
+func TestPgpEncryptRequired(t *testing.T) {
+    tests := []struct {
+        name string
+        encrypt func(plaintext []byte, publicKey []byte) ([]byte, error)
+    }{
+        {"nil", nil},
+        {"plaintext", func(plaintext []byte, publicKey []byte) ([]byte, error) { return plaintext, nil }},
+        {"binary", func(plaintext []byte, publicKey []byte) ([]byte, error) { return []byte{0x85, 0x01, 0x0c, 0x00}, nil }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_UTF8, Data: "secret"})
+            params.PgpConfig = GenPgpConfig([]byte("key"), tt.encrypt)
+            if b, err := BuildMessage(params); err == nil {
+                t.Errorf("BuildMessage() succeeded. message=%q", b)
+            }
+        })
+    }
+}
+
+
+func TestPgpContentError(t *testing.T) {
+    // The footer in non-ASCII can not be converted into ISO-2022-JP of the
+    // body without an encoder, which fails while composing the content.
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_ISO_2022_JP, Data: "hello"})
+    params.Footer = &Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Data: "こんにちは"}
+    called := false
+    params.PgpConfig = GenPgpConfig([]byte("key"), func(plaintext []byte, publicKey []byte) ([]byte, error) {
+        called = true
+        return testPgpEncrypt(plaintext, publicKey)
+    })
+    if b, err := BuildMessage(params); err == nil {
+        t.Errorf("BuildMessage() succeeded. message=%q", b)
+    }
+    if called {
+        t.Error("Encrypt is called with the content failed to be composed")
+    }
+}
+
@@ -0,0 +1,259 @@
+//////////////////////////////////////////////////////////////////////
+// pool.go
+//
+// @usage
+//
+//     The params are used as a template for the connections and the
+//     messages. Header and Body are given per message.
+//
+//     --------------------------------------------------
+//     pool := myMailer.GenPool(params, 30 * time.Second, 10 * time.Minute)
+//     defer pool.Close()
+//
+//     if err := pool.Send(header, body); err != nil {
+//         // Error handling.
+//     }
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "net/smtp"
+    "sync"
+    "time"
+)
+
+type Pool struct {
+    closed bool
+    done chan struct{}
+    idle []*pooledConn
+    maxIdle time.Duration  // Idle connections are closed after it. 0 means no limit.
+    maxLifetime time.Duration  // Connections are closed after it since connected. 0 means no limit.
+    mu sync.Mutex
+    params *Params
+}
+
+type pooledConn struct {
+    c *smtp.Client
+    connectedAt time.Time
+    usedAt time.Time
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate Pool Struct
+// Idle and expired connections are reaped in background until Close.
+// The limits are fixed at generation, since the reaper reads them.
+// params.Conn can not be used, since every connection is dialed by the pool.
+//////////////////////////////////////////////////////////////////////
+func GenPool(params *Params, maxIdle time.Duration, maxLifetime time.Duration) *Pool {
+    p := &Pool{
+        done: make(chan struct{}),
+        maxIdle: maxIdle,
+        maxLifetime: maxLifetime,
+        params: params,
+    }
+    interval := maxIdle
+    if interval == 0 || (maxLifetime != 0 && maxLifetime < interval) {
+        interval = maxLifetime
+    }
+    if interval > 0 {
+        interval /= 2
+        if interval < time.Second {
+            interval = time.Second
+        }
+        go p.reaper(interval)
+    }
+    return p
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send an email over a pooled connection.
+//////////////////////////////////////////////////////////////////////
+func (p *Pool) Send(header *Header, body []*Body) error {
+    start := time.Now()
+    if p.params.Conn != nil {
+        return errors.New("Params.Conn can not be used for Pool, which dials each connection")
+    }
+    params := *p.params
+    params.Header = header
+    params.Body = body
+    if err := params.Validate(); err != nil {
+        return err
+    }
+    msg, err := composeMessage(&params)
+    if err != nil {
+        return err
+    }
+    if params.EnforceFromMatch {
+        if err = checkFromMatch(&params); err != nil {
+            return err
+        }
+    }
+    pc, err := p.get()
+    if err != nil {
+        return err
+    }
+    phaseStart := time.Now()
+    if dataStarted, err := transact(pc.c, &params, msg); err != nil {
+        // The connection is reusable if the transaction can be aborted
+        // before DATA. Once the message data has started, RSET would be
+        // read as a part of it.
+        if !dataStarted && pc.c.Reset() == nil {
+            p.put(pc)
+        } else {
+            pc.c.Close()
+        }
+        return err
+    }
+    if params.Metrics != nil {
+        params.Metrics.DataDuration(time.Since(phaseStart))
+        params.Metrics.SendDuration(time.Since(start))
+    }
+    p.put(pc)
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Close the pool and all of the idle connections.
+//////////////////////////////////////////////////////////////////////
+func (p *Pool) Close() error {
+    p.mu.Lock()
+    if p.closed {
+        p.mu.Unlock()
+        return nil
+    }
+    p.closed = true
+    close(p.done)
+    idle := p.idle
+    p.idle = nil
+    p.mu.Unlock()
+    for _, pc := range idle {
+        pc.close()
+    }
+    return nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get a healthy idle connection, or connect a new one.
+//////////////////////////////////////////////////////////////////////
+func (p *Pool) get() (*pooledConn, error) {
+    for {
+        p.mu.Lock()
+        if p.closed {
+            p.mu.Unlock()
+            return nil, errors.New("pool is closed")
+        }
+        if len(p.idle) == 0 {
+            p.mu.Unlock()
+            break
+        }
+        pc := p.idle[len(p.idle) - 1]
+        p.idle = p.idle[:len(p.idle) - 1]
+        p.mu.Unlock()
+        if p.expired(pc, time.Now()) {
+            pc.close()
+            continue
+        }
+        if err := pc.c.Noop(); err != nil {
+            pc.c.Close()
+            continue
+        }
+        return pc, nil
+    }
+    phaseStart := time.Now()
+    c, err := dial(p.params)
+    if err != nil {
+        return nil, err
+    }
+    if p.params.Metrics != nil {
+        p.params.Metrics.ConnectDuration(time.Since(phaseStart))
+    }
+    if p.params.AuthConfig != nil {
+        phaseStart = time.Now()
+        if err = authenticate(c, p.params.AuthConfig, p.params.AllowInsecureAuth); err != nil {
+            c.Close()
+            return nil, err
+        }
+        if p.params.Metrics != nil {
+            p.params.Metrics.AuthDuration(time.Since(phaseStart))
+        }
+    }
+    return &pooledConn{c: c, connectedAt: time.Now()}, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Return the connection to the pool.
+//////////////////////////////////////////////////////////////////////
+func (p *Pool) put(pc *pooledConn) {
+    pc.usedAt = time.Now()
+    p.mu.Lock()
+    if p.closed {
+        p.mu.Unlock()
+        pc.close()
+        return
+    }
+    p.idle = append(p.idle, pc)
+    p.mu.Unlock()
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Close idle and expired connections periodically.
+//////////////////////////////////////////////////////////////////////
+func (p *Pool) reaper(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-p.done:
+            return
+        case now := <-ticker.C:
+            p.mu.Lock()
+            alive := make([]*pooledConn, 0, len(p.idle))
+            expired := make([]*pooledConn, 0)
+            for _, pc := range p.idle {
+                if p.expired(pc, now) {
+                    expired = append(expired, pc)
+                } else {
+                    alive = append(alive, pc)
+                }
+            }
+            p.idle = alive
+            p.mu.Unlock()
+            for _, pc := range expired {
+                pc.close()
+            }
+        }
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the connection has been idle or alive too long.
+//////////////////////////////////////////////////////////////////////
+func (p *Pool) expired(pc *pooledConn, now time.Time) bool {
+    if p.maxIdle > 0 && now.Sub(pc.usedAt) > p.maxIdle {
+        return true
+    }
+    return p.maxLifetime > 0 && now.Sub(pc.connectedAt) > p.maxLifetime
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Quit and close the connection.
+//////////////////////////////////////////////////////////////////////
+func (pc *pooledConn) close() {
+    if pc.c.Quit() != nil {
+        pc.c.Close()
+    }
+}
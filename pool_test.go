@@ -0,0 +1,53 @@
+//////////////////////////////////////////////////////////////////////
+// pool_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+
+func TestPoolSend(t *testing.T) {
+    s := startTestSmtpServer(t, nil)
+    params := genTestParams()
+    params.SmtpServerHost = "127.0.0.1"
+    params.SmtpServerPort = s.port()
+    pool := GenPool(params, time.Minute, time.Hour)
+    defer pool.Close()
+    for i := 0; i < 3; i++ {
+        header := GenHeader("from@example.com", "to@example.com", "subject", MIME_VERSION_1_0)
+        if err := pool.Send(header, []*Body{{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"}}); err != nil {
+            t.Fatalf("(*Pool) Send() error. err=%v", err)
+        }
+    }
+    if _, data := s.received(); len(data) != 3 {
+        t.Errorf("messages=%d, want 3", len(data))
+    }
+    if err := pool.Close(); err != nil {
+        t.Errorf("(*Pool) Close() error. err=%v", err)
+    }
+    if err := pool.Send(params.Header, nil); err == nil {
+        t.Error("(*Pool) Send() succeeded after Close()")
+    }
+}
+
+
+func TestPoolConn(t *testing.T) {
+    client, server := net.Pipe()
+    defer client.Close()
+    defer server.Close()
+    params := genTestParams()
+    params.Conn = client
+    pool := GenPool(params, 0, 0)
+    defer pool.Close()
+    if err := pool.Send(params.Header, nil); err == nil {
+        t.Error("(*Pool) Send() succeeded with Params.Conn")
+    }
+}
@@ -0,0 +1,64 @@
+//////////////////////////////////////////////////////////////////////
+// preview.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     htmlData, textData, err := myMailer.RenderPreview(params)
+//     if err != nil {
+//         // Error handling.
+//     }
+//     os.WriteFile("preview.html", []byte(htmlData), 0644)
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "encoding/base64"
+    "errors"
+    "regexp"
+)
+
+var cidRegexp = regexp.MustCompile(`cid:([^"'\s)>]+)`)
+
+
+//////////////////////////////////////////////////////////////////////
+// Render the HTML and text bodies as they would be sent, for previewing
+// in a browser. The footer and the preheader are applied, and "cid:"
+// references to the inline images are replaced with data URIs.
+// If there are 2 or more bodies of the same content type, the last one
+// is returned in according to RFC1341.
+//////////////////////////////////////////////////////////////////////
+func RenderPreview(params *Params) (string, string, error) {
+    var htmlData, textData string
+    for _, b := range composeBodies(params) {
+        if err := validateBody(b); err != nil {
+            return "", "", err
+        }
+        switch b.ContentType {
+        case CONTENT_TYPE_TEXT_HTML:
+            htmlData = b.Data
+        case CONTENT_TYPE_TEXT_PLAIN:
+            textData = b.Data
+        }
+    }
+    images := make(map[string]*InlineImage)
+    for _, img := range params.InlineImages {
+        if img.ContentID == "" {
+            return "", "", errors.New("inline image content ID is empty. fileName=" + img.FileName)
+        }
+        images[img.ContentID] = img
+    }
+    htmlData = cidRegexp.ReplaceAllStringFunc(htmlData, func(ref string) string {
+        img, ok := images[ref[len("cid:"):]]
+        if !ok {
+            return ref
+        }
+        return "data:" + img.ContentType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)
+    })
+    return htmlData, textData, nil
+}
@@ -0,0 +1,66 @@
+//////////////////////////////////////////////////////////////////////
+// registry.go
+//
+// @usage
+//
+//     1. Register templates once at startup.
+//
+//         --------------------------------------------------
+//         myMailer.RegisterTemplate("welcome.html", []string{"welcome.html", "head.html"})
+//         myMailer.RegisterTemplate("welcome.txt", []string{"welcome.txt"})
+//         --------------------------------------------------
+//
+//     2. Generate a mail body by the registered name.
+//
+//         --------------------------------------------------
+//         htmlBody, err := myMailer.GenBodyFromRegistered(
+//             "welcome.html",
+//             myMailer.CONTENT_TYPE_TEXT_HTML,
+//             myMailer.CHARSET_UTF8,
+//             bodyParams,
+//         )
+//         if err != nil {
+//             // Error handling.
+//         }
+//         --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "sync"
+)
+
+var (
+    registry = make(map[string][]string)
+    registryMu sync.RWMutex
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Register template files by a logical name.
+// Registering the same name again replaces the files.
+//////////////////////////////////////////////////////////////////////
+func RegisterTemplate(name string, files []string) {
+    registryMu.Lock()
+    defer registryMu.Unlock()
+    registry[name] = append([]string(nil), files...)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate a mail body from the template files registered by the name.
+//////////////////////////////////////////////////////////////////////
+func GenBodyFromRegistered(name string, contentType string, charset string, params map[string]string) (*Body, error) {
+    registryMu.RLock()
+    files, ok := registry[name]
+    registryMu.RUnlock()
+    if !ok {
+        return nil, errors.New("template is not registered. name=" + name)
+    }
+    return GenBodyFromFiles(contentType, charset, files, params)
+}
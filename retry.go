@@ -0,0 +1,166 @@
+//////////////////////////////////////////////////////////////////////
+// retry.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     retryConfig := myMailer.GenRetryConfig(3, 10 * time.Second)
+//
+//     // (Optional) Retry only on the specific SMTP reply codes.
+//     retryConfig.RetryCodes = []int{421, 450}
+//
+//     // (Optional) Cap the delays, including the ones hinted by the server.
+//     retryConfig.MaxDelay = 5 * time.Minute
+//
+//     if err := myMailer.SendWithRetry(params, retryConfig); err != nil {
+//         // Error handling.
+//     }
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "io"
+    "net"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// e.g.) "try again in 300 seconds", "Retry after 5 minutes"
+var retryHintRegexp = regexp.MustCompile(`(?i)\b(?:retry|try again|wait)\b\D{0,20}?(\d+)\s*(seconds?|secs?|s|minutes?|mins?|m|hours?|h)\b`)
+
+type RetryConfig struct {
+    Interval time.Duration  // The first delay, doubled on each retry unless the server hints one.
+    MaxAttempts int
+    MaxDelay time.Duration  // (Optional) Cap of the delays. 0 means no cap.
+    // (Optional) SMTP reply codes which trigger a retry.
+    // If empty, any transient (4xx) code triggers a retry.
+    RetryCodes []int
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Generate RetryConfig Struct
+//////////////////////////////////////////////////////////////////////
+func GenRetryConfig(maxAttempts int, interval time.Duration) *RetryConfig {
+    return &RetryConfig{
+        Interval: interval,
+        MaxAttempts: maxAttempts,
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Send Email, and retry on the SMTP errors configured as retryable, and
+// on transient network errors: timeouts, temporary DNS failures and
+// connections closed by the server.
+// The other errors (e.g. invalid params) are not retried, and neither is
+// any error after the message has been accepted, e.g. on QUIT.
+// The same message, including Header.IdempotencyKey, is sent on retries,
+// so attachments given by AttachReader, which can be read only once, are
+// not allowed.
+// If the reply hints a delay (e.g. "try again in 60 seconds"), it is
+// waited instead of the exponential backoff.
+//////////////////////////////////////////////////////////////////////
+func SendWithRetry(params *Params, retryConfig *RetryConfig) error {
+    if retryConfig.MaxAttempts > 1 {
+        for _, a := range params.Attachments {
+            if a != nil && a.reader != nil {
+                return errors.New("attachment reader can not be sent again on retries. fileName=" + a.FileName)
+            }
+        }
+    }
+    for attempt := 1; ; attempt++ {
+        accepted, err := send(params)
+        if err == nil {
+            return nil
+        }
+        if accepted || attempt >= retryConfig.MaxAttempts || !retryConfig.isRetryable(err) {
+            return err
+        }
+        time.Sleep(retryConfig.delay(err, attempt))
+    }
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Get the delay before the next attempt.
+//////////////////////////////////////////////////////////////////////
+func (r *RetryConfig) delay(err error, attempt int) time.Duration {
+    d, ok := retryHint(err)
+    if !ok {
+        d = r.Interval
+        for i := 1; i < attempt && (r.MaxDelay == 0 || d < r.MaxDelay); i++ {
+            d *= 2
+        }
+    }
+    if r.MaxDelay > 0 && d > r.MaxDelay {
+        return r.MaxDelay
+    }
+    return d
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Extract the delay hinted in the message of the SMTP error.
+//////////////////////////////////////////////////////////////////////
+func retryHint(err error) (time.Duration, bool) {
+    var smtpErr *SMTPError
+    if !errors.As(err, &smtpErr) {
+        return 0, false
+    }
+    m := retryHintRegexp.FindStringSubmatch(smtpErr.Message)
+    if m == nil {
+        return 0, false
+    }
+    unit := time.Second
+    switch strings.ToLower(m[2])[0] {
+    case 'm':
+        unit = time.Minute
+    case 'h':
+        unit = time.Hour
+    }
+    // A hint longer than a day is not likely to be a delay.
+    n, convErr := strconv.Atoi(m[1])
+    if convErr != nil || time.Duration(n) > 24 * time.Hour / unit {
+        return 0, false
+    }
+    return time.Duration(n) * unit, true
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Check if the error triggers a retry.
+// The other network errors (e.g. connection refused, a host not found)
+// would fail again in the same way.
+//////////////////////////////////////////////////////////////////////
+func (r *RetryConfig) isRetryable(err error) bool {
+    var dnsErr *net.DNSError
+    if errors.As(err, &dnsErr) {
+        return !dnsErr.IsNotFound && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+    }
+    var netErr net.Error
+    if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return true
+    }
+    var smtpErr *SMTPError
+    if !errors.As(err, &smtpErr) {
+        return false
+    }
+    if len(r.RetryCodes) == 0 {
+        return smtpErr.Temporary()
+    }
+    for _, code := range r.RetryCodes {
+        if smtpErr.Code == code {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,122 @@
+//////////////////////////////////////////////////////////////////////
+// retry_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "testing"
+    "time"
+)
+
+
+func TestIsRetryable(t *testing.T) {
+    refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+    timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+    tests := []struct {
+        name string
+        retryCodes []int
+        err error
+        want bool
+    }{
+        {"transient", nil, &SMTPError{Code: 421}, true},
+        {"permanent", nil, &SMTPError{Code: 550}, false},
+        {"wrapped transient", nil, fmt.Errorf("x error. err=%w", &SMTPError{Code: 451}), true},
+        {"retry codes", []int{452}, &SMTPError{Code: 452}, true},
+        {"not in retry codes", []int{452}, &SMTPError{Code: 421}, false},
+        {"connection refused", nil, fmt.Errorf("net.Dial() error. err=%w", refused), false},
+        {"timeout", nil, smtpError("(*Client) Data()", timeout), true},
+        {"deadline exceeded", nil, fmt.Errorf("(*Client) Data() error. err=%w", os.ErrDeadlineExceeded), true},
+        {"DNS timeout", nil, &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, true},
+        {"temporary DNS failure", nil, &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, true},
+        {"DNS not found", nil, &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, false},
+        {"DNS not found and temporary", nil, &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true, IsTemporary: true}, false},
+        {"EOF", nil, smtpError("(*Client) Data()", io.EOF), true},
+        {"unexpected EOF", nil, io.ErrUnexpectedEOF, true},
+        {"other", nil, errors.New("invalid params"), false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := GenRetryConfig(3, time.Second)
+            r.RetryCodes = tt.retryCodes
+            if got := r.isRetryable(tt.err); got != tt.want {
+                t.Errorf("isRetryable()=%v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+
+func TestSendWithRetryReader(t *testing.T) {
+    params := genTestParams(&Body{ContentType: CONTENT_TYPE_TEXT_PLAIN, Charset: CHARSET_US_ASCII, Data: "hello"})
+    params.AttachReader("a.bin", CONTENT_TYPE_APPLICATION_OCTET_STREAM, bytes.NewReader([]byte("data")), 4)
+    if err := SendWithRetry(params, GenRetryConfig(3, time.Millisecond)); err == nil {
+        t.Error("SendWithRetry() succeeded with an attachment reader")
+    }
+}
+
+
+func TestRetryHint(t *testing.T) {
+    tests := []struct {
+        name string
+        err error
+        want time.Duration
+        wantOk bool
+    }{
+        {"seconds", &SMTPError{Code: 421, Message: "Try again in 300 seconds"}, 300 * time.Second, true},
+        {"short seconds", &SMTPError{Code: 450, Message: "Greylisted, retry after 60s"}, 60 * time.Second, true},
+        {"minutes", &SMTPError{Code: 421, Message: "Retry after 5 minutes"}, 5 * time.Minute, true},
+        {"hours", &SMTPError{Code: 452, Message: "please wait 2 hours"}, 2 * time.Hour, true},
+        {"longer than a day", &SMTPError{Code: 421, Message: "try again in 48 hours"}, 0, false},
+        {"no hint", &SMTPError{Code: 421, Message: "Service not available"}, 0, false},
+        {"number without hint", &SMTPError{Code: 452, Message: "4.2.2 Mailbox full, 100 messages"}, 0, false},
+        {"wrapped", fmt.Errorf("send error. err=%w", &SMTPError{Code: 421, Message: "try again in 10 seconds"}), 10 * time.Second, true},
+        {"not SMTP error", errors.New("try again in 10 seconds"), 0, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, ok := retryHint(tt.err)
+            if got != tt.want || ok != tt.wantOk {
+                t.Errorf("retryHint()=%v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+            }
+        })
+    }
+}
+
+
+func TestRetryDelay(t *testing.T) {
+    noHint := &SMTPError{Code: 421, Message: "Service not available"}
+    tests := []struct {
+        name string
+        maxDelay time.Duration
+        err error
+        attempt int
+        want time.Duration
+    }{
+        {"first", 0, noHint, 1, time.Second},
+        {"doubled", 0, noHint, 2, 2 * time.Second},
+        {"doubled twice", 0, noHint, 3, 4 * time.Second},
+        {"capped", 3 * time.Second, noHint, 3, 3 * time.Second},
+        {"capped at many attempts", time.Minute, noHint, 100, time.Minute},
+        {"hint", 0, &SMTPError{Code: 421, Message: "try again in 30 seconds"}, 3, 30 * time.Second},
+        {"hint capped", 10 * time.Second, &SMTPError{Code: 421, Message: "try again in 30 seconds"}, 1, 10 * time.Second},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := GenRetryConfig(3, time.Second)
+            r.MaxDelay = tt.maxDelay
+            if got := r.delay(tt.err, tt.attempt); got != tt.want {
+                t.Errorf("delay()=%v, want %v", got, tt.want)
+            }
+        })
+    }
+}
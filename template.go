@@ -0,0 +1,122 @@
+//////////////////////////////////////////////////////////////////////
+// template.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     keys, err := myMailer.ExtractTemplateKeys(text)
+//     if err != nil {
+//         // Error handling.
+//     }
+//     for _, key := range keys {
+//         if _, ok := params[key]; !ok {
+//             // The template refers to a missing key.
+//         }
+//     }
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "errors"
+    "html/template"
+    "sort"
+    "text/template/parse"
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Extract the keys of params referred by the template, e.g. "name" of
+// {{ .name }}, $.name and {{ index . "name" }}. They are sorted and unique.
+// The templates defined in the text are included.
+// Inside {{ with }} and {{ range }}, the dot is not params any longer, so
+// the fields there, e.g. "title" of {{ range .items }}{{ .title }}{{ end }},
+// are not keys. $.name is still a key there.
+//////////////////////////////////////////////////////////////////////
+func ExtractTemplateKeys(text string) ([]string, error) {
+    t, err := template.New("t").Funcs(genFuncMap()).Parse(text)
+    if err != nil {
+        return nil, errors.New("(*Template) Parse() error. err=" + err.Error())
+    }
+    found := make(map[string]bool)
+    for _, tmpl := range t.Templates() {
+        if tmpl.Tree != nil {
+            collectTemplateKeys(tmpl.Tree.Root, true, found)
+        }
+    }
+    keys := make([]string, 0, len(found))
+    for key := range found {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Walk the parse tree and collect the keys.
+// isParamsDot tells whether the dot is params in the node.
+//////////////////////////////////////////////////////////////////////
+func collectTemplateKeys(node parse.Node, isParamsDot bool, found map[string]bool) {
+    switch n := node.(type) {
+    case *parse.ListNode:
+        if n == nil {
+            return
+        }
+        for _, child := range n.Nodes {
+            collectTemplateKeys(child, isParamsDot, found)
+        }
+    case *parse.ActionNode:
+        collectTemplateKeys(n.Pipe, isParamsDot, found)
+    case *parse.IfNode:
+        collectTemplateKeys(n.Pipe, isParamsDot, found)
+        collectTemplateKeys(n.List, isParamsDot, found)
+        collectTemplateKeys(n.ElseList, isParamsDot, found)
+    case *parse.RangeNode:
+        // The dot is set to each element in the list, but not in the else list.
+        collectTemplateKeys(n.Pipe, isParamsDot, found)
+        collectTemplateKeys(n.List, false, found)
+        collectTemplateKeys(n.ElseList, isParamsDot, found)
+    case *parse.WithNode:
+        // The dot is set to the value of the pipeline, but not in the else list.
+        collectTemplateKeys(n.Pipe, isParamsDot, found)
+        collectTemplateKeys(n.List, false, found)
+        collectTemplateKeys(n.ElseList, isParamsDot, found)
+    case *parse.TemplateNode:
+        collectTemplateKeys(n.Pipe, isParamsDot, found)
+    case *parse.PipeNode:
+        if n == nil {
+            return
+        }
+        for _, cmd := range n.Cmds {
+            collectTemplateKeys(cmd, isParamsDot, found)
+        }
+    case *parse.CommandNode:
+        // {{ index . "key" }}
+        if isParamsDot && len(n.Args) >= 3 {
+            ident, isIdent := n.Args[0].(*parse.IdentifierNode)
+            _, isDot := n.Args[1].(*parse.DotNode)
+            key, isString := n.Args[2].(*parse.StringNode)
+            if isIdent && ident.Ident == "index" && isDot && isString {
+                found[key.Text] = true
+            }
+        }
+        for _, arg := range n.Args {
+            collectTemplateKeys(arg, isParamsDot, found)
+        }
+    case *parse.ChainNode:
+        collectTemplateKeys(n.Node, isParamsDot, found)
+    case *parse.FieldNode:
+        if isParamsDot {
+            found[n.Ident[0]] = true
+        }
+    case *parse.VariableNode:
+        if n.Ident[0] == "$" && len(n.Ident) > 1 {
+            found[n.Ident[1]] = true
+        }
+    }
+}
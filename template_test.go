@@ -0,0 +1,72 @@
+//////////////////////////////////////////////////////////////////////
+// template_test.go
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "reflect"
+    "testing"
+)
+
+
+func TestExtractTemplateKeys(t *testing.T) {
+    tests := []struct {
+        name string
+        text string
+        want []string
+    }{
+        {"field", "{{ .name }} {{ .name }}", []string{"name"}},
+        {"nested field", "{{ .user.name }}", []string{"user"}},
+        {"root variable", "{{ $.name }}", []string{"name"}},
+        {"index", `{{ index . "first-name" }}`, []string{"first-name"}},
+        {"if", "{{ if .vip }}{{ .name }}{{ else }}{{ .guest }}{{ end }}", []string{"guest", "name", "vip"}},
+        {"with", "{{ with .user }}{{ .name }}{{ end }}", []string{"user"}},
+        {"with else", "{{ with .user }}{{ .name }}{{ else }}{{ .guest }}{{ end }}", []string{"guest", "user"}},
+        {"range", "{{ range .items }}{{ .title }} {{ $.currency }}{{ end }}", []string{"currency", "items"}},
+        {"range else", "{{ range .items }}{{ .title }}{{ else }}{{ .empty }}{{ end }}", []string{"empty", "items"}},
+        {"range index", `{{ range .items }}{{ index . "title" }}{{ end }}`, []string{"items"}},
+        {"nested with", "{{ with .a }}{{ with .b }}{{ .c }}{{ end }}{{ end }}", []string{"a"}},
+        {"define", `{{ define "footer" }}{{ .company }}{{ end }}{{ .name }}{{ template "footer" . }}`, []string{"company", "name"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := ExtractTemplateKeys(tt.text)
+            if err != nil {
+                t.Fatalf("ExtractTemplateKeys() error. err=%v", err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("ExtractTemplateKeys()=%q, want %q", got, tt.want)
+            }
+        })
+    }
+    if _, err := ExtractTemplateKeys("{{ .name "); err == nil {
+        t.Error("ExtractTemplateKeys() succeeded for a broken template")
+    }
+}
+
+
+func TestGenBodyFromStringsOrder(t *testing.T) {
+    named := map[string]string{
+        "root": `{{ define "footer" }}root footer{{ end }}{{ template "header" . }} {{ .name }} {{ template "footer" . }}`,
+        "header": "Hello",
+        "footer": "named footer",
+        "a": `{{ define "header" }}a header{{ end }}`,
+        "z": `{{ define "header" }}z header{{ end }}`,
+    }
+    // The later definition wins: the named footer over the root, and z over a and header.
+    want := "z header world named footer"
+    for i := 0; i < 20; i++ {
+        body, err := GenBodyFromStrings(CONTENT_TYPE_TEXT_PLAIN, CHARSET_UTF8, named, "root", map[string]string{"name": "world"})
+        if err != nil {
+            t.Fatalf("GenBodyFromStrings() error. err=%v", err)
+        }
+        if body.Data != want {
+            t.Fatalf("Data=%q, want %q", body.Data, want)
+        }
+    }
+}
+
@@ -0,0 +1,76 @@
+//////////////////////////////////////////////////////////////////////
+// text.go
+//
+// @usage
+//
+//     --------------------------------------------------
+//     text := myMailer.HtmlToText(htmlBody.Data)
+//     --------------------------------------------------
+//
+//     Block elements (e.g. <p>, <div>, <tr>) and <br> are converted into
+//     line breaks, list items are prefixed with "- ", and links are
+//     followed by their URLs in parentheses.
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "html"
+    "regexp"
+    "strings"
+)
+
+var (
+    htmlAnchorRegexp = regexp.MustCompile(`(?is)<a\s[^>]*?href\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)[^>]*>(.*?)</a>`)
+    htmlBlockTagRegexp = regexp.MustCompile(`(?i)</?(?:address|article|blockquote|center|div|footer|h[1-6]|header|hr|ol|p|section|table|tr|ul)(?:\s[^>]*)?/?>`)
+    htmlBreakTagRegexp = regexp.MustCompile(`(?i)<br\s*/?>`)
+    htmlCellTagRegexp = regexp.MustCompile(`(?i)</t[dh]>`)
+    htmlCommentRegexp = regexp.MustCompile(`(?s)<!--.*?-->`)
+    htmlImgAltRegexp = regexp.MustCompile(`(?i)<img\s[^>]*?alt\s*=\s*("[^"]*"|'[^']*')[^>]*>`)
+    htmlInvisibleRegexp = regexp.MustCompile(`(?is)<(head|script|style|title)[^>]*>.*?</(?:head|script|style|title)>`)
+    htmlListItemRegexp = regexp.MustCompile(`(?i)<li(?:\s[^>]*)?>`)
+    htmlTagRegexp = regexp.MustCompile(`(?s)<[^>]*>`)
+    textBlankLinesRegexp = regexp.MustCompile(`\n{3,}`)
+    textSpacesRegexp = regexp.MustCompile(`[ \t\r\f\v]+`)
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Convert HTML into plain text, e.g. for the text part of an alternative.
+//////////////////////////////////////////////////////////////////////
+func HtmlToText(s string) string {
+    s = htmlCommentRegexp.ReplaceAllString(s, "")
+    s = htmlInvisibleRegexp.ReplaceAllString(s, "")
+    // Whitespace in HTML source is not significant.
+    s = strings.Join(strings.Fields(s), " ")
+    s = htmlAnchorRegexp.ReplaceAllStringFunc(s, func(a string) string {
+        m := htmlAnchorRegexp.FindStringSubmatch(a)
+        href := html.UnescapeString(strings.Trim(m[1], `"'`))
+        text := strings.TrimSpace(m[2])
+        plain := strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(text, "")))
+        if href == "" || strings.HasPrefix(href, "#") || plain == href || strings.TrimPrefix(href, "mailto:") == plain {
+            return text
+        }
+        return text + " (" + href + ")"
+    })
+    s = htmlImgAltRegexp.ReplaceAllStringFunc(s, func(img string) string {
+        return strings.Trim(htmlImgAltRegexp.FindStringSubmatch(img)[1], `"'`)
+    })
+    s = htmlBreakTagRegexp.ReplaceAllString(s, "\n")
+    s = htmlListItemRegexp.ReplaceAllString(s, "\n- ")
+    s = htmlCellTagRegexp.ReplaceAllString(s, " ")
+    s = htmlBlockTagRegexp.ReplaceAllString(s, "\n\n")
+    s = htmlTagRegexp.ReplaceAllString(s, "")
+    s = html.UnescapeString(s)
+    s = strings.ReplaceAll(s, "\u00a0", " ")
+    lines := strings.Split(s, "\n")
+    for i, l := range lines {
+        lines[i] = strings.TrimSpace(textSpacesRegexp.ReplaceAllString(l, " "))
+    }
+    s = strings.Join(lines, "\n")
+    s = textBlankLinesRegexp.ReplaceAllString(s, "\n\n")
+    return strings.TrimSpace(s)
+}
@@ -0,0 +1,136 @@
+//////////////////////////////////////////////////////////////////////
+// validate.go
+//
+// @usage
+//
+//     Send calls Validate first, so it is needed only to check the params
+//     beforehand, e.g. at startup.
+//
+//     --------------------------------------------------
+//     if err := params.Validate(); err != nil {
+//         // All of the problems are joined into err.
+//     }
+//     --------------------------------------------------
+//
+// MIT License
+//
+// Copyright (c) 2019 noknow.info
+//////////////////////////////////////////////////////////////////////
+package mailer
+
+import (
+    "crypto/tls"
+    "errors"
+    "mime"
+    "net/mail"
+    "strconv"
+    "strings"
+)
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate the params before sending.
+// It does not stop at the first problem, and all of them are joined
+// into the error with errors.Join.
+//////////////////////////////////////////////////////////////////////
+func (p *Params) Validate() error {
+    errs := make([]error, 0)
+    if p.SmtpServerHost == "" {
+        errs = append(errs, errors.New("SmtpServerHost is empty"))
+    }
+    // The port is not used for a Unix domain socket or a given connection.
+    if !strings.HasPrefix(p.SmtpServerHost, "unix:") && p.Conn == nil && (p.SmtpServerPort <= 0 || p.SmtpServerPort > 65535) {
+        errs = append(errs, errors.New("invalid SmtpServerPort. port=" + strconv.Itoa(p.SmtpServerPort)))
+    }
+    if p.Header == nil {
+        errs = append(errs, errors.New("Header is nil"))
+    } else {
+        errs = append(errs, validateHeader(p)...)
+    }
+    for i, b := range p.Body {
+        if b == nil {
+            errs = append(errs, errors.New("Body is nil. index=" + strconv.Itoa(i)))
+        } else if err := validateBody(b); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    for i, a := range p.Attachments {
+        if a == nil {
+            errs = append(errs, errors.New("Attachment is nil. index=" + strconv.Itoa(i)))
+        } else if mime.FormatMediaType(a.ContentType, nil) == "" {
+            errs = append(errs, errors.New("invalid content type. contentType=" + strconv.Quote(a.ContentType)))
+        }
+    }
+    for i, img := range p.InlineImages {
+        if img == nil {
+            errs = append(errs, errors.New("InlineImage is nil. index=" + strconv.Itoa(i)))
+        } else if mime.FormatMediaType(img.ContentType, nil) == "" {
+            errs = append(errs, errors.New("invalid content type. contentType=" + strconv.Quote(img.ContentType)))
+        }
+    }
+    if p.PgpConfig != nil && p.PgpConfig.Encrypt == nil {
+        errs = append(errs, errors.New("PgpConfig.Encrypt is nil"))
+    }
+    errs = append(errs, validateAuthTls(p)...)
+    return errors.Join(errs...)
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate the addresses and the header values.
+//////////////////////////////////////////////////////////////////////
+func validateHeader(p *Params) []error {
+    errs := make([]error, 0)
+    header := p.Header
+    if header.From == "" {
+        errs = append(errs, errors.New("From is empty"))
+    } else if _, err := mail.ParseAddressList(header.From); err != nil {
+        errs = append(errs, errors.New("mail.ParseAddressList() error. from=" + header.From + " err=" + err.Error()))
+    }
+    rcpts := recipients(header)
+    if len(rcpts) == 0 {
+        errs = append(errs, errors.New("recipients are empty"))
+    }
+    for _, rcpt := range rcpts {
+        if _, err := mail.ParseAddress(rcpt); err != nil {
+            errs = append(errs, errors.New("mail.ParseAddress() error. address=" + rcpt + " err=" + err.Error()))
+        }
+    }
+    // The raw header is validated when it is set.
+    if p.rawHeader != "" {
+        return errs
+    }
+    fields, err := genHeaders(p)
+    if err != nil {
+        return append(errs, err)
+    }
+    for _, f := range fields {
+        if !isFoldedHeaderValue(f.Value) {
+            errs = append(errs, errors.New("invalid header value. name=" + f.Name + ", value=" + strconv.Quote(f.Value)))
+        }
+    }
+    return errs
+}
+
+
+//////////////////////////////////////////////////////////////////////
+// Validate that the auth and TLS settings work together.
+//////////////////////////////////////////////////////////////////////
+func validateAuthTls(p *Params) []error {
+    errs := make([]error, 0)
+    authConfig := p.AuthConfig
+    if authConfig == nil {
+        return errs
+    }
+    if authConfig.Auth == nil && authConfig.Crammd5Auth == nil && authConfig.PlainAuth == nil && authConfig.ScramSha256Auth == nil {
+        return append(errs, errors.New("AuthConfig has no auth"))
+    }
+    // PLAIN alone would be refused on sending without TLS.
+    _, isTlsConn := p.Conn.(*tls.Conn)
+    secure := p.TlsConfig != nil || p.StartTls || isTlsConn
+    plainOnly := authConfig.Auth == nil && authConfig.Crammd5Auth == nil && authConfig.ScramSha256Auth == nil
+    if plainOnly && !secure && !p.AllowInsecureAuth {
+        errs = append(errs, errors.New("PLAIN auth requires TLS or StartTls unless AllowInsecureAuth is set"))
+    }
+    return errs
+}